@@ -2,27 +2,15 @@ package main
 
 import (
 	"os"
-	"strconv"
-	"time"
 
 	"github.com/georgebuckerfield/caretaker/caretaker"
 )
 
-const (
-	envConfigInterval     = "BACKGROUND_WORKER_INTERVAL"
-	defaultConfigInterval = 60
-)
-
 func main() {
-
-	// Interval sets the frequency of the background worker:
-	var interval time.Duration
-
-	envInterval, err := strconv.Atoi(os.Getenv(envConfigInterval))
-	if err != nil {
-		interval = time.Duration(defaultConfigInterval) * time.Second
-	} else {
-		interval = time.Duration(envInterval) * time.Second
+	// With arguments, run a one-shot CLI command instead of the
+	// server.
+	if len(os.Args) > 1 {
+		os.Exit(caretaker.RunCLI(os.Args[1:]))
 	}
-	caretaker.StartServer(interval)
+	os.Exit(caretaker.StartServer())
 }
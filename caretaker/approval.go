@@ -0,0 +1,100 @@
+package caretaker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	api_v1 "k8s.io/client-go/pkg/api/v1"
+)
+
+// Some services are too sensitive for self-service whitelisting to
+// take effect immediately. Marking one with the approval annotation
+// routes every add through an external approval service first: the
+// request details are POSTed to the configured URL and the change
+// only proceeds on an approved answer. Everything else — a denial, a
+// timeout, a transport error, or no URL configured at all — fails
+// closed with 403.
+
+const approvalAnnotation = "service.caretaker.requireapproval"
+
+// approvalRequest is the payload POSTed to the approval service.
+type approvalRequest struct {
+	Domain    string `json:"domain,omitempty"`
+	Service   string `json:"service"`
+	Namespace string `json:"namespace"`
+	IpAddress string `json:"ipaddress"`
+	TTL       string `json:"ttl,omitempty"`
+	Requester string `json:"requester,omitempty"`
+	Ticket    string `json:"ticket,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// approvalResponse is the approver's verdict. A non-200 status denies
+// regardless of the body.
+type approvalResponse struct {
+	Approved bool   `json:"approved"`
+	Reason   string `json:"reason"`
+}
+
+// requiresApproval reports whether the service opted in to the
+// approval gate via its annotation.
+func requiresApproval(s *api_v1.Service) bool {
+	required, err := strconv.ParseBool(s.ObjectMeta.Annotations[approvalAnnotation])
+	return err == nil && required
+}
+
+// checkApproval asks the configured approval service whether an add to
+// the given service may proceed. Services without the annotation pass
+// straight through.
+func checkApproval(ctx context.Context, data WhitelistRequest, service *api_v1.Service) error {
+	if !requiresApproval(service) {
+		return nil
+	}
+	ns := service.ObjectMeta.Namespace
+	name := service.ObjectMeta.Name
+	if cfg.ApprovalURL == "" {
+		return errForbidden("Service %s/%s requires approval but no approval service is configured", ns, name)
+	}
+	body, err := json.Marshal(approvalRequest{
+		Domain:    data.Domain,
+		Service:   name,
+		Namespace: ns,
+		IpAddress: data.IpAddress,
+		TTL:       data.TTL,
+		Requester: requesterFromContext(ctx),
+		Ticket:    data.Ticket,
+		Reason:    data.Reason,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, cfg.ApprovalURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{Timeout: cfg.ApprovalTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		logErrorf("Approval request for service %s/%s failed: %s", ns, name, err)
+		return errForbidden("Approval for service %s/%s could not be obtained", ns, name)
+	}
+	defer resp.Body.Close()
+	// The verdict body is decoded best-effort: a denial may or may not
+	// carry a structured reason.
+	var verdict approvalResponse
+	if err := json.NewDecoder(resp.Body).Decode(&verdict); err != nil {
+		verdict = approvalResponse{}
+	}
+	if resp.StatusCode == http.StatusOK && verdict.Approved {
+		return nil
+	}
+	if verdict.Reason != "" {
+		return errForbidden("Whitelist request denied by approver: %s", verdict.Reason)
+	}
+	return errForbidden("Whitelist request denied by approver")
+}
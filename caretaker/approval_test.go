@@ -0,0 +1,81 @@
+package caretaker
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	api_v1 "k8s.io/client-go/pkg/api/v1"
+)
+
+func approvalTestService(annotations map[string]string) *api_v1.Service {
+	return &api_v1.Service{
+		ObjectMeta: meta_v1.ObjectMeta{
+			Name:        "ingress-nginx",
+			Namespace:   "default",
+			Annotations: annotations,
+		},
+	}
+}
+
+func TestCheckApprovalSkipsUnannotatedServices(t *testing.T) {
+	service := approvalTestService(map[string]string{defaultMgmtAnnotation: "true"})
+	if err := checkApproval(context.Background(), WhitelistRequest{}, service); err != nil {
+		t.Errorf("unannotated service was gated: %s", err)
+	}
+}
+
+func TestCheckApprovalFailsClosedWithoutURL(t *testing.T) {
+	service := approvalTestService(map[string]string{approvalAnnotation: "true"})
+	err := checkApproval(context.Background(), WhitelistRequest{}, service)
+	if err == nil {
+		t.Fatalf("annotated service passed without an approval service configured")
+	}
+	if httpStatusForError(err) != http.StatusForbidden {
+		t.Errorf("status = %d, want %d", httpStatusForError(err), http.StatusForbidden)
+	}
+}
+
+func TestCheckApprovalVerdicts(t *testing.T) {
+	service := approvalTestService(map[string]string{approvalAnnotation: "true"})
+	data := WhitelistRequest{Domain: "test.example.com", IpAddress: "1.2.3.4", Ticket: "CHG-1"}
+
+	var got approvalRequest
+	verdict := approvalResponse{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("undecodable approval payload: %s", err)
+		}
+		json.NewEncoder(w).Encode(verdict)
+	}))
+	defer server.Close()
+	cfg.ApprovalURL = server.URL
+	defer func() { cfg.ApprovalURL = "" }()
+
+	verdict = approvalResponse{Approved: true}
+	if err := checkApproval(context.Background(), data, service); err != nil {
+		t.Errorf("approved request rejected: %s", err)
+	}
+	if got.Domain != data.Domain || got.IpAddress != data.IpAddress || got.Ticket != data.Ticket {
+		t.Errorf("approval payload %+v does not match request %+v", got, data)
+	}
+	if got.Service != "ingress-nginx" || got.Namespace != "default" {
+		t.Errorf("approval payload names service %s/%s, want default/ingress-nginx", got.Namespace, got.Service)
+	}
+
+	verdict = approvalResponse{Approved: false, Reason: "change freeze"}
+	err := checkApproval(context.Background(), data, service)
+	if err == nil {
+		t.Fatalf("denied request passed")
+	}
+	if httpStatusForError(err) != http.StatusForbidden {
+		t.Errorf("status = %d, want %d", httpStatusForError(err), http.StatusForbidden)
+	}
+	if !strings.Contains(err.Error(), "change freeze") {
+		t.Errorf("error %q does not carry the approver's reason", err)
+	}
+}
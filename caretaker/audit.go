@@ -0,0 +1,98 @@
+package caretaker
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// The audit trail is distinct from general logging: one append-only
+// JSON line per mutating action, recording who changed what when, for
+// compliance pipelines. Audit lines bypass the log level entirely so
+// they can never be suppressed by quieting the logger. The sink is
+// "stdout" or a file path; empty disables auditing.
+const auditStdoutSink = "stdout"
+
+// auditRecord is one line of the audit trail.
+type auditRecord struct {
+	Timestamp string `json:"timestamp"`
+	Actor     string `json:"actor,omitempty"`
+	Action    string `json:"action"`
+	Domain    string `json:"domain,omitempty"`
+	Service   string `json:"service,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	IpAddress string `json:"ipaddress"`
+	TTL       string `json:"ttl,omitempty"`
+	Ticket    string `json:"ticket,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+	Outcome   string `json:"outcome"`
+	Error     string `json:"error,omitempty"`
+}
+
+var audit struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// configureAudit (re)opens the configured audit sink. An unopenable
+// file disables auditing loudly rather than dropping lines silently
+// later.
+func configureAudit() {
+	audit.mu.Lock()
+	defer audit.mu.Unlock()
+	switch cfg.AuditSink {
+	case "":
+		audit.w = nil
+	case auditStdoutSink:
+		audit.w = os.Stdout
+	default:
+		f, err := os.OpenFile(cfg.AuditSink, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			logErrorf("Unable to open audit sink %s: %s", cfg.AuditSink, err)
+			audit.w = nil
+			return
+		}
+		audit.w = f
+	}
+}
+
+// auditMutation records one add or remove attempt and its outcome. The
+// actor is the requester identity supplied with the request.
+func auditMutation(ctx context.Context, action string, data WhitelistRequest, err error) {
+	actor, _ := ctx.Value(contextKey(requesterKey)).(string)
+	rec := auditRecord{
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		Actor:     actor,
+		Action:    action,
+		Domain:    data.Domain,
+		Service:   data.Service,
+		Namespace: data.Namespace,
+		IpAddress: data.IpAddress,
+		TTL:       data.TTL,
+		Ticket:    data.Ticket,
+		Reason:    data.Reason,
+		RequestID: requestIDFromContext(ctx),
+		Outcome:   "success",
+	}
+	if err != nil {
+		rec.Outcome = "failure"
+		rec.Error = err.Error()
+	}
+	line, merr := json.Marshal(rec)
+	if merr != nil {
+		logErrorf("Unable to encode audit record: %s", merr)
+		return
+	}
+	audit.mu.Lock()
+	defer audit.mu.Unlock()
+	if audit.w == nil {
+		return
+	}
+	if _, werr := audit.w.Write(append(line, '\n')); werr != nil {
+		logErrorf("Unable to write audit record: %s", werr)
+	}
+}
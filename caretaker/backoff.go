@@ -0,0 +1,92 @@
+package caretaker
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// The work queue's rate limiter only delays re-enqueues it performed
+// itself; the informer's resync re-adds every key at full rate, so a
+// persistently failing service would be retried on every tick forever.
+// This table gives each failing service its own exponential backoff:
+// while a service is backing off, reconcile attempts are deferred, and
+// the first success clears it. Delays are jittered so a batch of
+// services failing together does not retry in lockstep.
+const (
+	backoffBase   = time.Second
+	backoffMax    = 5 * time.Minute
+	backoffJitter = 0.2
+)
+
+type backoffEntry struct {
+	failures int
+	until    time.Time
+}
+
+var reconcileBackoff = struct {
+	mu sync.Mutex
+	m  map[string]backoffEntry
+}{m: make(map[string]backoffEntry)}
+
+// backoffRemaining reports how much longer the service must wait
+// before another reconcile attempt, zero when it may run now.
+func backoffRemaining(key string) time.Duration {
+	reconcileBackoff.mu.Lock()
+	defer reconcileBackoff.mu.Unlock()
+	entry, ok := reconcileBackoff.m[key]
+	if !ok {
+		return 0
+	}
+	if remaining := time.Until(entry.until); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+// recordBackoffFailure notes another failure for the service and
+// returns the jittered delay before the next attempt.
+func recordBackoffFailure(key string) time.Duration {
+	reconcileBackoff.mu.Lock()
+	defer reconcileBackoff.mu.Unlock()
+	entry := reconcileBackoff.m[key]
+	delay := backoffBase << uint(entry.failures)
+	if delay > backoffMax || delay <= 0 {
+		delay = backoffMax
+	}
+	// Spread the delay across +/- the jitter fraction.
+	delay = time.Duration(float64(delay) * (1 - backoffJitter + 2*backoffJitter*rand.Float64()))
+	entry.failures++
+	entry.until = time.Now().Add(delay)
+	reconcileBackoff.m[key] = entry
+	updateBackoffGauge()
+	return delay
+}
+
+// clearBackoff forgets the service's failure history after a
+// successful reconcile.
+func clearBackoff(key string) {
+	reconcileBackoff.mu.Lock()
+	defer reconcileBackoff.mu.Unlock()
+	if _, ok := reconcileBackoff.m[key]; !ok {
+		return
+	}
+	delete(reconcileBackoff.m, key)
+	updateBackoffGauge()
+}
+
+// updateBackoffGauge recounts the services still waiting out a delay
+// and prunes entries whose delay has lapsed without a success. Called
+// with the table locked.
+func updateBackoffGauge() {
+	now := time.Now()
+	waiting := 0
+	for key, entry := range reconcileBackoff.m {
+		if now.Before(entry.until) {
+			waiting++
+		} else if now.Sub(entry.until) > backoffMax {
+			delete(reconcileBackoff.m, key)
+		}
+	}
+	metrics.setServicesInBackoff(waiting)
+}
@@ -0,0 +1,115 @@
+package caretaker
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// RunCLI executes a one-shot whitelist operation against the cluster
+// without starting the HTTP server, and returns the process exit code.
+// Supported commands are add, remove, list and migrate.
+func RunCLI(args []string) int {
+	LoadConfig()
+	// Global flags before the command select the cluster to talk to.
+	global := flag.NewFlagSet("caretaker", flag.ExitOnError)
+	kubeconfig := global.String("kubeconfig", "", "path to a kubeconfig file (default: KUBECONFIG or $HOME/.kube/config)")
+	kubeContext := global.String("context", "", "kubeconfig context to use (default: current context)")
+	global.Usage = cliUsage
+	global.Parse(args)
+	args = global.Args()
+	if *kubeconfig != "" {
+		cfg.Kubeconfig = *kubeconfig
+	}
+	if *kubeContext != "" {
+		cfg.KubeContext = *kubeContext
+	}
+	if len(args) < 1 {
+		cliUsage()
+		return 2
+	}
+	ctx := context.Background()
+	switch args[0] {
+	case "add":
+		flags := flag.NewFlagSet("add", flag.ExitOnError)
+		domain := flags.String("domain", "", "domain to whitelist against")
+		ip := flags.String("ip", "", "IP address or CIDR to whitelist")
+		ttl := flags.String("ttl", "", "optional lifetime for the entry, e.g. 4h")
+		ticket := flags.String("ticket", "", "optional ticket reference")
+		flags.Parse(args[1:])
+		data := WhitelistRequest{Domain: *domain, IpAddress: *ip, TTL: *ttl, Ticket: *ticket}
+		deadline, _, err := ApplyRequestToCluster(ctx, data)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			return 1
+		}
+		if _, remaining := describeDeadline(deadline); remaining != "" {
+			fmt.Printf("IP %s whitelisted until %s (expires in %s)\n", *ip, deadline, remaining)
+		} else {
+			fmt.Printf("IP %s whitelisted until %s\n", *ip, deadline)
+		}
+	case "remove":
+		flags := flag.NewFlagSet("remove", flag.ExitOnError)
+		domain := flags.String("domain", "", "domain the entry belongs to")
+		ip := flags.String("ip", "", "IP address or CIDR to remove")
+		subnet := flags.Bool("subnet", false, "remove every whitelisted range contained in the CIDR")
+		flags.Parse(args[1:])
+		data := WhitelistRequest{Domain: *domain, IpAddress: *ip, Subnet: *subnet}
+		if *subnet {
+			removed, err := RemoveSubnetFromCluster(ctx, data)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+				return 1
+			}
+			for _, r := range removed {
+				fmt.Printf("IP %s removed\n", r)
+			}
+			break
+		}
+		if err := RemoveRequestFromCluster(ctx, data); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			return 1
+		}
+		fmt.Printf("IP %s removed\n", *ip)
+	case "migrate":
+		clientset, err := GetClientset()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			return 1
+		}
+		migrated, skipped, err := MigrateAnnotationValues(ctx, clientset)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			return 1
+		}
+		fmt.Printf("Migrated %d services, %d already current\n", migrated, skipped)
+	case "list":
+		clientset, err := GetClientset()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			return 1
+		}
+		entries, err := ListWhitelistEntries(ctx, clientset)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			return 1
+		}
+		for _, e := range entries {
+			fmt.Printf("%s/%s\t%s\t%s\n", e.Namespace, e.Service, e.IpAddress, e.Deadline)
+		}
+	default:
+		cliUsage()
+		return 2
+	}
+	return 0
+}
+
+func cliUsage() {
+	fmt.Fprintf(os.Stderr, "Usage: caretaker [-kubeconfig <path>] [-context <name>] [add|remove|list|migrate]\n")
+	fmt.Fprintf(os.Stderr, "  add    -domain <fqdn> -ip <addr> [-ttl <duration>] [-ticket <ref>]\n")
+	fmt.Fprintf(os.Stderr, "  remove -domain <fqdn> -ip <addr> [-subnet]\n")
+	fmt.Fprintf(os.Stderr, "  list\n")
+	fmt.Fprintf(os.Stderr, "  migrate   rewrite stored annotation values into the current format\n")
+	fmt.Fprintf(os.Stderr, "With no command, the HTTP server and reconciler are started.\n")
+}
@@ -0,0 +1,69 @@
+package caretaker
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// One caretaker instance can front several clusters: each configured
+// cluster is a named kubeconfig context, and requests pick one with
+// the "cluster" field. The empty name is the default cluster (the
+// in-cluster credentials or the default context), so single-cluster
+// deployments are unaffected. In-cluster mode stays single-cluster;
+// extra clusters always come from the kubeconfig.
+var clusterClients = struct {
+	mu sync.Mutex
+	m  map[string]*kubernetes.Clientset
+}{m: make(map[string]*kubernetes.Clientset)}
+
+// GetClientsetFor returns the client for the named cluster, building
+// and caching it on first use. An unknown name is a client error.
+func GetClientsetFor(cluster string) (*kubernetes.Clientset, error) {
+	if cluster == "" {
+		return GetClientset()
+	}
+	kubeContext, ok := cfg.Clusters[cluster]
+	if !ok {
+		return nil, errBadRequest("Unknown cluster %q, configured clusters: %s", cluster, strings.Join(clusterNames(), ", "))
+	}
+	clusterClients.mu.Lock()
+	defer clusterClients.mu.Unlock()
+	if c, ok := clusterClients.m[cluster]; ok {
+		return c, nil
+	}
+	c, err := getClientsetForContext(kubeContext)
+	if err != nil {
+		return nil, err
+	}
+	clusterClients.m[cluster] = c
+	return c, nil
+}
+
+func clusterNames() []string {
+	names := make([]string, 0, len(cfg.Clusters))
+	for name := range cfg.Clusters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// getClientsetForContext is getClientsetExternal pinned to a specific
+// kubeconfig context.
+func getClientsetForContext(kubeContext string) (*kubernetes.Clientset, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	if cfg.Kubeconfig != "" {
+		rules.ExplicitPath = cfg.Kubeconfig
+	}
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: kubeContext}
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides).ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	config.Timeout = cfg.APITimeout
+	return kubernetes.NewForConfig(config)
+}
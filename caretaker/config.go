@@ -0,0 +1,582 @@
+package caretaker
+
+import (
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	envApplyToRelated    = "CARETAKER_APPLY_RELATED"
+	envRelatedLabel      = "CARETAKER_RELATED_LABEL"
+	envLegacyPrefixes    = "CARETAKER_LEGACY_PREFIXES"
+	envRequireTLSHost    = "CARETAKER_REQUIRE_TLS_HOST"
+	envRequireTicket     = "CARETAKER_REQUIRE_TICKET"
+	envDefaultTTL        = "CARETAKER_DEFAULT_TTL"
+	envControllerSvc     = "CARETAKER_CONTROLLER_SERVICE"
+	envReconcileInterval = "CARETAKER_RECONCILE_INTERVAL"
+	// envLegacyInterval is the original interval setting, in seconds.
+	envLegacyInterval = "BACKGROUND_WORKER_INTERVAL"
+	envAuthToken      = "CARETAKER_AUTH_TOKEN"
+	envTLSCert        = "CARETAKER_TLS_CERT"
+	envTLSKey         = "CARETAKER_TLS_KEY"
+	envRateLimitQPS   = "CARETAKER_RATE_LIMIT_QPS"
+	envRateLimitBurst = "CARETAKER_RATE_LIMIT_BURST"
+	envDryRun         = "CARETAKER_DRY_RUN"
+	envAPITimeout     = "CARETAKER_API_TIMEOUT"
+	envMaxRanges      = "CARETAKER_MAX_RANGES"
+	envMaxAnnotations = "CARETAKER_MAX_ANNOTATION_BYTES"
+	envEndpointPath   = "CARETAKER_ENDPOINT_PATH"
+	envStartupGrace   = "CARETAKER_STARTUP_GRACE"
+	envClassServices  = "CARETAKER_CLASS_SERVICES"
+	// envMgmtAnnotation and envAnnotationPrefix override the annotation
+	// keys caretaker reads and writes, so independent instances can run
+	// in one cluster without touching each other's entries.
+	envMgmtAnnotation   = "CARETAKER_MGMT_ANNOTATION"
+	envAnnotationPrefix = "CARETAKER_ANNOTATION_PREFIX"
+	envLeaderElect      = "CARETAKER_LEADER_ELECT"
+	envLeaderLockName   = "CARETAKER_LEADER_LOCK_NAME"
+	envLeaderLockNs     = "CARETAKER_LEADER_LOCK_NAMESPACE"
+	envKubeconfig       = "CARETAKER_KUBECONFIG"
+	envKubeContext      = "CARETAKER_CONTEXT"
+	envEmitEvents       = "CARETAKER_EMIT_EVENTS"
+	envReconcileWorkers = "CARETAKER_RECONCILE_WORKERS"
+	envPersistState     = "CARETAKER_PERSIST_STATE"
+	envStateConfigMap   = "CARETAKER_STATE_CONFIGMAP"
+	envStateNamespace   = "CARETAKER_STATE_NAMESPACE"
+	envWebhookURL       = "CARETAKER_WEBHOOK_URL"
+	envWebhookSecret    = "CARETAKER_WEBHOOK_SECRET"
+	envSlackWebhookURL  = "CARETAKER_SLACK_WEBHOOK_URL"
+	envSlackChannel     = "CARETAKER_SLACK_CHANNEL"
+	envExpiryWarning    = "CARETAKER_EXPIRY_WARNING"
+	envMaxTTL           = "CARETAKER_MAX_TTL"
+	envClampTTL         = "CARETAKER_CLAMP_TTL"
+	envListenAddr       = "CARETAKER_LISTEN_ADDR"
+	envNamespaces       = "CARETAKER_NAMESPACES"
+	envEmptyRanges      = "CARETAKER_EMPTY_RANGES_POLICY"
+	envPlaceholderRange = "CARETAKER_PLACEHOLDER_RANGE"
+	envBaselineRanges   = "CARETAKER_BASELINE_RANGES"
+	envAuthTokenFile    = "CARETAKER_TOKEN_FILE"
+	envServiceCacheTTL  = "CARETAKER_SERVICE_CACHE_TTL"
+	envIngressCacheTTL  = "CARETAKER_INGRESS_CACHE_TTL"
+	envMode             = "CARETAKER_MODE"
+	envDeadlineFormat   = "CARETAKER_DEADLINE_FORMAT"
+	envNearExpiry       = "CARETAKER_NEAR_EXPIRY_WINDOW"
+	envTimezone         = "CARETAKER_TIMEZONE"
+	envAllowedDomains   = "CARETAKER_ALLOWED_DOMAINS"
+	envCooldown         = "CARETAKER_COOLDOWN"
+	envAuditSink        = "CARETAKER_AUDIT_LOG"
+	envClusters         = "CARETAKER_CLUSTERS"
+	envRBACStrict       = "CARETAKER_RBAC_STRICT"
+	envReadOnly         = "CARETAKER_READ_ONLY"
+	envIngressClasses   = "CARETAKER_INGRESS_CLASSES"
+	envApprovalURL      = "CARETAKER_APPROVAL_URL"
+	envApprovalTimeout  = "CARETAKER_APPROVAL_TIMEOUT"
+	envMaxRenewals      = "CARETAKER_MAX_RENEWALS"
+	envUpdateStrategy   = "CARETAKER_UPDATE_STRATEGY"
+	envPolicyConfigMap  = "CARETAKER_POLICY_CONFIGMAP"
+	// envOTLPEndpoint is the standard OpenTelemetry exporter variable,
+	// deliberately not CARETAKER-prefixed.
+	envOTLPEndpoint = "OTEL_EXPORTER_OTLP_ENDPOINT"
+)
+
+// Config holds the runtime options for caretaker, populated from the
+// environment by LoadConfig.
+type Config struct {
+	// ApplyToRelated makes whitelist changes fan out to services
+	// related to the controller service via ownerReferences or the
+	// RelatedLabel.
+	ApplyToRelated bool
+	// RelatedLabel names a label whose value ties related services
+	// together. Empty disables label-based matching.
+	RelatedLabel string
+	// LegacyAnnotationPrefixes lists annotation prefixes used by
+	// previous versions of caretaker. The reconciler still expires
+	// entries under these prefixes and migrates live ones to the
+	// current prefix.
+	LegacyAnnotationPrefixes []string
+	// RequireTLSHost rejects whitelist requests for domains that do
+	// not appear in the ingress's TLS hosts.
+	RequireTLSHost bool
+	// RequireTicket rejects whitelist requests that do not carry a
+	// ticket/reference ID.
+	RequireTicket bool
+	// DefaultTTL is how long a whitelist entry lives before the
+	// reconciler removes it, unless overridden elsewhere.
+	DefaultTTL time.Duration
+	// ControllerService pins the ingress controller service as
+	// "namespace/name", bypassing dynamic discovery.
+	ControllerService string
+	// ReconcileInterval is how often the background worker sweeps for
+	// expired whitelist entries.
+	ReconcileInterval time.Duration
+	// AuthToken is the bearer token required on the whitelist
+	// endpoints. Empty disables authentication. AuthTokenFile points
+	// at a mounted Secret file whose contents take precedence over
+	// AuthToken and are re-read while running.
+	AuthToken     string
+	AuthTokenFile string
+	// TLSCertFile and TLSKeyFile enable TLS on the API server when
+	// both are set.
+	TLSCertFile string
+	TLSKeyFile  string
+	// RateLimitQPS and RateLimitBurst bound how fast a single source
+	// IP may issue mutating requests. A QPS of zero disables limiting.
+	RateLimitQPS   float32
+	RateLimitBurst int
+	// DryRun logs the changes that would be made without updating any
+	// services.
+	DryRun bool
+	// APITimeout bounds individual requests to the Kubernetes API.
+	APITimeout time.Duration
+	// MaxRangesPerService caps how many ranges may be whitelisted on
+	// one service. Zero means no limit.
+	MaxRangesPerService int
+	// EndpointPath is where the mutating whitelist handler is served.
+	EndpointPath string
+	// ClassServices maps an ingress class to the controller service
+	// ("namespace/name") fronting it, bypassing auto-discovery for
+	// that class. An explicit controllerService in a request takes
+	// precedence over this mapping, which takes precedence over
+	// discovery.
+	ClassServices map[string]string
+	// IngressClasses lists extra ingress class names accepted as
+	// nginx-compatible, for controllers deployed under a class other
+	// than the plain "nginx" default.
+	IngressClasses []string
+	// StartupGrace defers expiry removals for this long after the
+	// process starts; a cold cache or skewed clock right after a
+	// restart must not cut access prematurely. Zero disables it.
+	StartupGrace time.Duration
+	// MaxAnnotationBytes rejects adds that would push a service's
+	// total annotation size past this threshold, before Kubernetes
+	// itself refuses the write. Zero disables the check.
+	MaxAnnotationBytes int
+	// MaxRenewals caps how many times one entry's deadline may be
+	// extended before it must fully expire, so temporary access cannot
+	// be renewed indefinitely. Zero means unlimited.
+	MaxRenewals int
+	// MgmtAnnotation is the annotation marking a service as managed by
+	// this caretaker instance.
+	MgmtAnnotation string
+	// AnnotationKeyPrefix is the prefix under which whitelist entries
+	// are stored on a service.
+	AnnotationKeyPrefix string
+	// LeaderElect makes replicas compete for a lock so only one runs
+	// the reconciler. LeaderLockName and LeaderLockNamespace locate the
+	// lock ConfigMap.
+	LeaderElect         bool
+	LeaderLockName      string
+	LeaderLockNamespace string
+	// Kubeconfig and KubeContext override the kubeconfig file and
+	// context used when running outside the cluster. When empty the
+	// standard KUBECONFIG/$HOME/.kube/config resolution applies.
+	Kubeconfig  string
+	KubeContext string
+	// EmitEvents records a Kubernetes Event on the target service
+	// whenever a whitelist entry is added or removed.
+	EmitEvents bool
+	// ReconcileWorkers is how many services the reconciler processes in
+	// parallel. It bounds concurrent updates against the API server.
+	ReconcileWorkers int
+	// PersistState mirrors whitelist entries into a controller-owned
+	// ConfigMap so deadlines survive annotation clobbering.
+	// StateConfigMap and StateNamespace locate it.
+	PersistState   bool
+	StateConfigMap string
+	StateNamespace string
+	// WebhookURL enables outbound webhook notifications for whitelist
+	// changes. WebhookSecret, when set, keys the HMAC signature on each
+	// delivery.
+	WebhookURL    string
+	WebhookSecret string
+	// ApprovalURL is the external approval service consulted before a
+	// whitelist add to a service annotated as requiring approval.
+	// Empty means annotated services reject every add, failing closed.
+	// ApprovalTimeout bounds the call.
+	ApprovalURL     string
+	ApprovalTimeout time.Duration
+	// SlackWebhookURL enables Slack notifications for whitelist
+	// changes; SlackChannel optionally overrides the webhook's default
+	// channel.
+	SlackWebhookURL string
+	SlackChannel    string
+	// ExpiryWarningWindow notifies about entries this long before
+	// their deadline, once per entry. Zero disables the warning.
+	ExpiryWarningWindow time.Duration
+	// MaxTTL is the hard ceiling on entry lifetimes; zero disables it.
+	// ClampTTL clamps excessive TTLs to the ceiling instead of
+	// rejecting the request.
+	MaxTTL   time.Duration
+	ClampTTL bool
+	// ListenAddr is the address the API server binds to.
+	ListenAddr string
+	// WatchNamespaces limits caretaker to the listed namespaces, so it
+	// can run with namespaced RBAC. Empty means all namespaces.
+	WatchNamespaces []string
+	// EmptyRangesPolicy decides what happens when a removal would leave
+	// a service with no source ranges (allow-all): "warn", "block" or
+	// "placeholder". PlaceholderRange is the range substituted by the
+	// placeholder policy.
+	EmptyRangesPolicy string
+	PlaceholderRange  string
+	// BaselineRanges are always kept on managed services and never
+	// expire; they carry no deadline annotations.
+	BaselineRanges []string
+	// ServiceCacheTTL is how long a full service list may be reused
+	// before re-listing. Keep it well under ReconcileInterval; zero
+	// disables the cache.
+	ServiceCacheTTL time.Duration
+	// IngressCacheTTL is how long the per-namespace host index of
+	// ingresses may be reused before re-listing; zero disables the
+	// cache and every lookup lists afresh.
+	IngressCacheTTL time.Duration
+	// Mode selects which halves of caretaker run in this process:
+	// "server" (HTTP API only), "worker" (reconciler only) or "both".
+	// It lets the stateless API scale out while the reconciler runs as
+	// a leader-elected singleton.
+	Mode string
+	// UpdateStrategy selects how service changes are written back:
+	// a full update or a merge patch limited to the fields caretaker
+	// manages.
+	UpdateStrategy string
+	// DeadlineFormat selects how deadlines are serialized into
+	// annotations: "rfc3339" or "unix" (epoch seconds), for external
+	// systems that consume the annotations. The reader accepts every
+	// supported format regardless, so mixed-format annotations coexist.
+	DeadlineFormat string
+	// NearExpiryWindow is how close to its deadline an entry must be to
+	// count towards the near-expiry gauge, which feeds "mass expiry"
+	// alerts.
+	NearExpiryWindow time.Duration
+	// DisplayLocation is the timezone used when rendering deadlines for
+	// operators, in API status messages, events and logs. Storage and
+	// expiry comparisons always use absolute instants regardless.
+	DisplayLocation *time.Location
+	// AllowedDomains restricts the API to domains matching one of the
+	// glob patterns. PolicyConfigMap ("namespace/name") supplies
+	// further patterns and allowed service labels, re-read while
+	// running. Both empty means no restriction.
+	AllowedDomains  []string
+	PolicyConfigMap string
+	// OTLPEndpoint enables tracing: spans around cluster operations
+	// are exported to this OTLP/HTTP collector. Empty disables tracing
+	// entirely.
+	OTLPEndpoint string
+	// CooldownWindow refuses reversing an add with a remove (or vice
+	// versa) for the same service and IP within the window, to stop
+	// automation flapping the load balancer. Zero disables it.
+	CooldownWindow time.Duration
+	// AuditSink is where the audit trail of mutating actions goes:
+	// "stdout" or a file path. Empty disables auditing.
+	AuditSink string
+	// Clusters maps cluster names to kubeconfig contexts, letting one
+	// instance front several clusters. Requests pick a cluster by
+	// name; empty targets the default cluster.
+	Clusters map[string]string
+	// RBACStrict fails the readiness probe when the startup RBAC
+	// self-check finds a missing permission, instead of only warning.
+	RBACStrict bool
+	// ReadOnly rejects every mutating endpoint with 403 and disables
+	// the background worker, so an instance can run with read-only
+	// RBAC and expose status broadly.
+	ReadOnly bool
+}
+
+const (
+	defaultLeaderLockName    = "caretaker-leader"
+	defaultLeaderLockNs      = "default"
+	defaultTTL               = 48 * time.Hour
+	defaultMaxTTL            = 7 * 24 * time.Hour
+	defaultListenAddr        = ":8000"
+	defaultPlaceholderRange  = "127.0.0.1/32"
+	defaultServiceCacheTTL   = 10 * time.Second
+	defaultIngressCacheTTL   = 10 * time.Second
+	defaultReconcileInterval = 60 * time.Second
+	defaultRateLimitBurst    = 5
+	defaultReconcileWorkers  = 4
+	defaultStateConfigMap    = "caretaker-state"
+	defaultStateNs           = "default"
+	defaultAPITimeout        = 30 * time.Second
+	defaultNearExpiryWindow  = 15 * time.Minute
+	defaultApprovalTimeout   = 5 * time.Second
+)
+
+var cfg = defaultConfig()
+
+func defaultConfig() *Config {
+	return &Config{
+		DefaultTTL:          defaultTTL,
+		ReconcileInterval:   defaultReconcileInterval,
+		RateLimitBurst:      defaultRateLimitBurst,
+		APITimeout:          defaultAPITimeout,
+		MgmtAnnotation:      defaultMgmtAnnotation,
+		AnnotationKeyPrefix: defaultAnnotationKeyPrefix,
+		LeaderLockName:      defaultLeaderLockName,
+		LeaderLockNamespace: defaultLeaderLockNs,
+		EmitEvents:          true,
+		MaxTTL:              defaultMaxTTL,
+		ListenAddr:          defaultListenAddr,
+		EmptyRangesPolicy:   emptyRangesWarn,
+		PlaceholderRange:    defaultPlaceholderRange,
+		ServiceCacheTTL:     defaultServiceCacheTTL,
+		IngressCacheTTL:     defaultIngressCacheTTL,
+		ReconcileWorkers:    defaultReconcileWorkers,
+		StateConfigMap:      defaultStateConfigMap,
+		StateNamespace:      defaultStateNs,
+		Mode:                modeBoth,
+		UpdateStrategy:      updateStrategyUpdate,
+		DeadlineFormat:      deadlineFormatRFC3339,
+		NearExpiryWindow:    defaultNearExpiryWindow,
+		DisplayLocation:     time.Local,
+		MaxAnnotationBytes:  defaultMaxAnnotationBytes,
+		EndpointPath:        defaultEndpointPath,
+		StartupGrace:        defaultStartupGrace,
+		ApprovalTimeout:     defaultApprovalTimeout,
+	}
+}
+
+// LoadConfig reads the caretaker configuration from the environment.
+func LoadConfig() {
+	initLogger()
+	cfg.ApplyToRelated = envBool(envApplyToRelated, false)
+	cfg.RelatedLabel = os.Getenv(envRelatedLabel)
+	cfg.LegacyAnnotationPrefixes = envList(envLegacyPrefixes)
+	cfg.RequireTLSHost = envBool(envRequireTLSHost, false)
+	cfg.RequireTicket = envBool(envRequireTicket, false)
+	cfg.DefaultTTL = envDuration(envDefaultTTL, defaultTTL)
+	cfg.ControllerService = os.Getenv(envControllerSvc)
+	cfg.ReconcileInterval = reconcileIntervalFromEnv()
+	cfg.AuthToken = os.Getenv(envAuthToken)
+	cfg.TLSCertFile = os.Getenv(envTLSCert)
+	cfg.TLSKeyFile = os.Getenv(envTLSKey)
+	cfg.RateLimitQPS = envFloat(envRateLimitQPS, 0)
+	cfg.RateLimitBurst = envInt(envRateLimitBurst, defaultRateLimitBurst)
+	cfg.DryRun = envBool(envDryRun, false)
+	cfg.APITimeout = envDuration(envAPITimeout, defaultAPITimeout)
+	cfg.MaxRangesPerService = envInt(envMaxRanges, 0)
+	cfg.MaxAnnotationBytes = envInt(envMaxAnnotations, defaultMaxAnnotationBytes)
+	cfg.MaxRenewals = envInt(envMaxRenewals, 0)
+	cfg.EndpointPath = envEndpointPathChoice(envEndpointPath)
+	cfg.StartupGrace = envDuration(envStartupGrace, defaultStartupGrace)
+	cfg.ClassServices = envMap(envClassServices)
+	cfg.MgmtAnnotation = envAnnotationKey(envMgmtAnnotation, defaultMgmtAnnotation)
+	cfg.AnnotationKeyPrefix = envAnnotationKey(envAnnotationPrefix, defaultAnnotationKeyPrefix)
+	cfg.LeaderElect = envBool(envLeaderElect, false)
+	cfg.LeaderLockName = envString(envLeaderLockName, defaultLeaderLockName)
+	cfg.LeaderLockNamespace = envString(envLeaderLockNs, defaultLeaderLockNs)
+	cfg.Kubeconfig = os.Getenv(envKubeconfig)
+	cfg.KubeContext = os.Getenv(envKubeContext)
+	cfg.EmitEvents = envBool(envEmitEvents, true)
+	cfg.ReconcileWorkers = envInt(envReconcileWorkers, defaultReconcileWorkers)
+	cfg.PersistState = envBool(envPersistState, false)
+	cfg.StateConfigMap = envString(envStateConfigMap, defaultStateConfigMap)
+	cfg.StateNamespace = envString(envStateNamespace, defaultStateNs)
+	cfg.WebhookURL = os.Getenv(envWebhookURL)
+	cfg.WebhookSecret = os.Getenv(envWebhookSecret)
+	cfg.SlackWebhookURL = os.Getenv(envSlackWebhookURL)
+	cfg.SlackChannel = os.Getenv(envSlackChannel)
+	cfg.ExpiryWarningWindow = envDuration(envExpiryWarning, 0)
+	cfg.MaxTTL = envDuration(envMaxTTL, defaultMaxTTL)
+	cfg.ClampTTL = envBool(envClampTTL, false)
+	cfg.ListenAddr = envString(envListenAddr, defaultListenAddr)
+	cfg.WatchNamespaces = envList(envNamespaces)
+	cfg.EmptyRangesPolicy = envString(envEmptyRanges, emptyRangesWarn)
+	cfg.PlaceholderRange = envString(envPlaceholderRange, defaultPlaceholderRange)
+	cfg.BaselineRanges = envList(envBaselineRanges)
+	cfg.AuthTokenFile = os.Getenv(envAuthTokenFile)
+	cfg.ServiceCacheTTL = envDuration(envServiceCacheTTL, defaultServiceCacheTTL)
+	cfg.IngressCacheTTL = envDuration(envIngressCacheTTL, defaultIngressCacheTTL)
+	cfg.Mode = envRunMode(envMode)
+	cfg.UpdateStrategy = envUpdateStrategyChoice(envUpdateStrategy)
+	cfg.DeadlineFormat = envDeadlineFormatChoice(envDeadlineFormat)
+	cfg.NearExpiryWindow = envDuration(envNearExpiry, defaultNearExpiryWindow)
+	cfg.DisplayLocation = envLocation(envTimezone)
+	cfg.AllowedDomains = envList(envAllowedDomains)
+	cfg.PolicyConfigMap = os.Getenv(envPolicyConfigMap)
+	cfg.OTLPEndpoint = os.Getenv(envOTLPEndpoint)
+	cfg.CooldownWindow = envDuration(envCooldown, 0)
+	cfg.AuditSink = os.Getenv(envAuditSink)
+	cfg.Clusters = envMap(envClusters)
+	cfg.RBACStrict = envBool(envRBACStrict, false)
+	cfg.ReadOnly = envBool(envReadOnly, false)
+	cfg.IngressClasses = envList(envIngressClasses)
+	cfg.ApprovalURL = os.Getenv(envApprovalURL)
+	cfg.ApprovalTimeout = envDuration(envApprovalTimeout, defaultApprovalTimeout)
+	refreshAuthToken()
+	configureNotifiers()
+	configureAudit()
+}
+
+// reconcileIntervalFromEnv prefers the duration-valued setting but
+// still honors the original BACKGROUND_WORKER_INTERVAL, which counts
+// seconds.
+func reconcileIntervalFromEnv() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv(envReconcileInterval)); err == nil && d > 0 {
+		return d
+	}
+	if n, err := strconv.Atoi(os.Getenv(envLegacyInterval)); err == nil && n > 0 {
+		return time.Duration(n) * time.Second
+	}
+	return defaultReconcileInterval
+}
+
+// annotationKeyPattern matches syntactically valid annotation keys: an
+// optional DNS-subdomain prefix followed by a qualified name.
+var annotationKeyPattern = regexp.MustCompile(`^([a-z0-9]([-a-z0-9.]*[a-z0-9])?/)?[A-Za-z0-9]([-A-Za-z0-9_.]*[A-Za-z0-9])?$`)
+
+// envAnnotationKey reads an annotation-key override, falling back to
+// the default when the value is not a valid Kubernetes annotation key.
+func envAnnotationKey(key, fallback string) string {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	if len(v) > 253 || !annotationKeyPattern.MatchString(v) {
+		logWarnf("Ignoring %s=%q: not a valid annotation key", key, v)
+		return fallback
+	}
+	return v
+}
+
+// envRunMode reads the run mode, running both halves when the value is
+// not a known mode.
+func envRunMode(key string) string {
+	switch v := os.Getenv(key); v {
+	case "", modeBoth:
+		return modeBoth
+	case modeServer, modeWorker:
+		return v
+	default:
+		logWarnf("Ignoring %s=%q: must be %q, %q or %q", key, v, modeServer, modeWorker, modeBoth)
+		return modeBoth
+	}
+}
+
+// envEndpointPathChoice reads the whitelist endpoint path, falling
+// back to the default when the value is not an absolute path.
+func envEndpointPathChoice(key string) string {
+	v := os.Getenv(key)
+	if v == "" {
+		return defaultEndpointPath
+	}
+	if !strings.HasPrefix(v, "/") || v == "/" {
+		logWarnf("Ignoring %s=%q: must be an absolute path other than \"/\"", key, v)
+		return defaultEndpointPath
+	}
+	return v
+}
+
+// envUpdateStrategyChoice reads the write strategy, falling back to
+// full updates when the value is not a known strategy.
+func envUpdateStrategyChoice(key string) string {
+	switch v := os.Getenv(key); v {
+	case "", updateStrategyUpdate:
+		return updateStrategyUpdate
+	case updateStrategyPatch:
+		return updateStrategyPatch
+	default:
+		logWarnf("Ignoring %s=%q: must be %q or %q", key, v, updateStrategyUpdate, updateStrategyPatch)
+		return updateStrategyUpdate
+	}
+}
+
+// envDeadlineFormatChoice reads the deadline serialization format,
+// falling back to RFC3339 when the value is not a known format.
+func envDeadlineFormatChoice(key string) string {
+	switch v := os.Getenv(key); v {
+	case "", deadlineFormatRFC3339:
+		return deadlineFormatRFC3339
+	case deadlineFormatUnix:
+		return v
+	default:
+		logWarnf("Ignoring %s=%q: must be %q or %q", key, v, deadlineFormatRFC3339, deadlineFormatUnix)
+		return deadlineFormatRFC3339
+	}
+}
+
+// envLocation loads the display timezone as an IANA name, failing fast
+// at startup on an unknown zone rather than mislabeling deadlines for
+// the process's lifetime.
+func envLocation(key string) *time.Location {
+	v := os.Getenv(key)
+	if v == "" {
+		return time.Local
+	}
+	loc, err := time.LoadLocation(v)
+	if err != nil {
+		logErrorf("Invalid %s value %q: %s", key, v, err)
+		os.Exit(1)
+	}
+	return loc
+}
+
+func envString(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func envFloat(key string, fallback float32) float32 {
+	f, err := strconv.ParseFloat(os.Getenv(key), 32)
+	if err != nil {
+		return fallback
+	}
+	return float32(f)
+}
+
+func envInt(key string, fallback int) int {
+	n, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return n
+}
+
+func envDuration(key string, fallback time.Duration) time.Duration {
+	d, err := time.ParseDuration(os.Getenv(key))
+	if err != nil || d <= 0 {
+		return fallback
+	}
+	return d
+}
+
+func envList(key string) []string {
+	v := os.Getenv(key)
+	if v == "" {
+		return nil
+	}
+	var out []string
+	for _, item := range strings.Split(v, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// envMap parses comma-separated name=value pairs.
+func envMap(key string) map[string]string {
+	out := make(map[string]string)
+	for _, item := range envList(key) {
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			logWarnf("Ignoring malformed %s entry %q, expected name=value", key, item)
+			continue
+		}
+		out[parts[0]] = parts[1]
+	}
+	return out
+}
+
+func envBool(key string, fallback bool) bool {
+	v, err := strconv.ParseBool(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return v
+}
@@ -0,0 +1,70 @@
+package caretaker
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	api_v1 "k8s.io/client-go/pkg/api/v1"
+)
+
+// The cooldown guards against automation flapping the same IP on and
+// off a service: every spec change triggers a cloud load-balancer
+// update, which costs money and burns provider rate limits. After an
+// add, an immediate removal of the same IP is refused for the window,
+// and vice versa; repeating the same action stays allowed so deadline
+// refreshes keep working. The record is in-memory only — a restart
+// forgets it — which is fine for a throttle. The window defaults to
+// zero, i.e. off.
+type cooldownRecord struct {
+	action string
+	at     time.Time
+}
+
+var cooldowns = struct {
+	mu sync.Mutex
+	m  map[string]cooldownRecord
+}{m: make(map[string]cooldownRecord)}
+
+func cooldownKey(s *api_v1.Service, ip string) string {
+	return fmt.Sprintf("%s/%s/%s", s.ObjectMeta.Namespace, s.ObjectMeta.Name, ip)
+}
+
+// checkCooldown refuses the action when the opposite action on the
+// same (service, IP) pair happened within the configured window.
+func checkCooldown(s *api_v1.Service, ip, action string) error {
+	if cfg.CooldownWindow <= 0 {
+		return nil
+	}
+	cooldowns.mu.Lock()
+	defer cooldowns.mu.Unlock()
+	last, ok := cooldowns.m[cooldownKey(s, ip)]
+	if !ok || last.action == action {
+		return nil
+	}
+	elapsed := time.Since(last.at)
+	if elapsed >= cfg.CooldownWindow {
+		return nil
+	}
+	return errTooManyRequests("IP %s on service %s/%s had a %s %s ago, retry in %s",
+		ip, s.ObjectMeta.Namespace, s.ObjectMeta.Name, last.action,
+		elapsed.Round(time.Second), (cfg.CooldownWindow - elapsed).Round(time.Second))
+}
+
+// recordAction notes a completed API-driven add or remove. Expiries by
+// the reconciler are deliberately not recorded: re-requesting access
+// after it lapsed is not flapping.
+func recordAction(s *api_v1.Service, ip, action string) {
+	if cfg.CooldownWindow <= 0 {
+		return
+	}
+	cooldowns.mu.Lock()
+	defer cooldowns.mu.Unlock()
+	now := time.Now()
+	for key, rec := range cooldowns.m {
+		if now.Sub(rec.at) > cfg.CooldownWindow {
+			delete(cooldowns.m, key)
+		}
+	}
+	cooldowns.m[cooldownKey(s, ip)] = cooldownRecord{action: action, at: now}
+}
@@ -0,0 +1,68 @@
+package caretaker
+
+import (
+	"fmt"
+
+	"k8s.io/client-go/kubernetes"
+	api_v1 "k8s.io/client-go/pkg/api/v1"
+
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Event reasons recorded on a service when its whitelist changes. They
+// show up in `kubectl describe service` alongside the change details.
+const (
+	eventReasonAdded    = "WhitelistAdded"
+	eventReasonExpired  = "WhitelistExpired"
+	eventReasonRemoved  = "WhitelistRemoved"
+	eventReasonExpiring = "WhitelistExpiring"
+	eventReasonOpen     = "SourceRangesEmpty"
+
+	eventComponent = "caretaker"
+)
+
+// recordServiceEvent emits a Normal event on the service, for in-cluster
+// auditing of whitelist changes. The vendored client lacks the record
+// package's dependencies, so events are created directly; there is no
+// aggregation, which is fine at whitelist-change rates. Emission can be
+// switched off with CARETAKER_EMIT_EVENTS when it is too noisy.
+func recordServiceEvent(c kubernetes.Interface, s *api_v1.Service, reason, messageFmt string, args ...interface{}) {
+	recordEvent(c, s, api_v1.EventTypeNormal, reason, messageFmt, args...)
+}
+
+// recordServiceWarning is recordServiceEvent with the Warning type, for
+// conditions an operator should look at.
+func recordServiceWarning(c kubernetes.Interface, s *api_v1.Service, reason, messageFmt string, args ...interface{}) {
+	recordEvent(c, s, api_v1.EventTypeWarning, reason, messageFmt, args...)
+}
+
+func recordEvent(c kubernetes.Interface, s *api_v1.Service, eventType, reason, messageFmt string, args ...interface{}) {
+	if !cfg.EmitEvents {
+		return
+	}
+	now := meta_v1.Now()
+	event := &api_v1.Event{
+		ObjectMeta: meta_v1.ObjectMeta{
+			GenerateName: fmt.Sprintf("%s.", s.ObjectMeta.Name),
+			Namespace:    s.ObjectMeta.Namespace,
+		},
+		InvolvedObject: api_v1.ObjectReference{
+			Kind:            "Service",
+			Namespace:       s.ObjectMeta.Namespace,
+			Name:            s.ObjectMeta.Name,
+			UID:             s.ObjectMeta.UID,
+			APIVersion:      "v1",
+			ResourceVersion: s.ObjectMeta.ResourceVersion,
+		},
+		Reason:         reason,
+		Message:        fmt.Sprintf(messageFmt, args...),
+		Source:         api_v1.EventSource{Component: eventComponent},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+		Type:           eventType,
+	}
+	if _, err := c.CoreV1().Events(s.ObjectMeta.Namespace).Create(event); err != nil {
+		logWarnf("Unable to record event on service %s/%s: %s", s.ObjectMeta.Namespace, s.ObjectMeta.Name, err)
+	}
+}
@@ -0,0 +1,103 @@
+package caretaker
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+)
+
+// FindIngForFqdn used to list every ingress in scope on every request
+// and scan the rules in Go, which is O(ingresses) against the API
+// server per call and heavy on big clusters. The host index memoizes
+// the per-namespace ingress lists for a short TTL and keys the rules
+// by host, so lookups inside the TTL are map hits. The TTL should stay
+// short: a brand-new ingress is invisible until its namespace's index
+// refreshes.
+type ingressHostIndex struct {
+	mu          sync.Mutex
+	byNamespace map[string]*namespaceIngressIndex
+}
+
+// namespaceIngressIndex is the host index for one namespace. Wildcard
+// rules cannot be keyed by the requested domain, so they are kept as a
+// list and matched at lookup time.
+type namespaceIngressIndex struct {
+	fetched   time.Time
+	exact     map[string][]ingressMatch
+	wildcards []ingressMatch
+}
+
+var ingressIndex = &ingressHostIndex{byNamespace: make(map[string]*namespaceIngressIndex)}
+
+// reset discards every cached namespace index.
+func (x *ingressHostIndex) reset() {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.byNamespace = make(map[string]*namespaceIngressIndex)
+}
+
+// lookup returns the exact and wildcard matches for the domain across
+// the given namespaces, refreshing any stale namespace index first.
+func (x *ingressHostIndex) lookup(f string, namespaces []string, c kubernetes.Interface) (exact, wildcards []ingressMatch, err error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for _, namespace := range namespaces {
+		idx := x.byNamespace[namespace]
+		if idx == nil || cfg.IngressCacheTTL <= 0 || time.Since(idx.fetched) > cfg.IngressCacheTTL {
+			idx, err = buildNamespaceIndex(namespace, c)
+			if err != nil {
+				return nil, nil, err
+			}
+			x.byNamespace[namespace] = idx
+		}
+		exact = append(exact, idx.exact[f]...)
+		// An ingress contributes one wildcard match at most, mirroring
+		// the per-ingress short-circuit of the old linear scan.
+		seen := make(map[string]bool)
+		for _, m := range idx.wildcards {
+			key := m.ing.ObjectMeta.Namespace + "/" + m.ing.ObjectMeta.Name
+			if seen[key] || !wildcardHostMatches(normalizeHost(m.rule.Host), f) {
+				continue
+			}
+			seen[key] = true
+			wildcards = append(wildcards, m)
+		}
+	}
+	return exact, wildcards, nil
+}
+
+// buildNamespaceIndex lists the namespace's ingresses once and indexes
+// their rules by host.
+func buildNamespaceIndex(namespace string, c kubernetes.Interface) (*namespaceIngressIndex, error) {
+	items, err := listIngresses(namespace, c)
+	if err != nil {
+		return nil, err
+	}
+	idx := &namespaceIngressIndex{
+		fetched: time.Now(),
+		exact:   make(map[string][]ingressMatch),
+	}
+	for _, i := range items {
+		indexed := make(map[string]bool)
+		for _, r := range i.Spec.Rules {
+			// Hosts are indexed in normalized form so trailing-dot and
+			// IDN spellings on either side still line up.
+			host := normalizeHost(r.Host)
+			if strings.HasPrefix(host, "*.") {
+				idx.wildcards = append(idx.wildcards, ingressMatch{ing: i, rule: r})
+				continue
+			}
+			// Only the first rule per host counts within one ingress,
+			// as with the old scan; duplicate hosts across ingresses
+			// still surface as an ambiguity.
+			if indexed[host] {
+				continue
+			}
+			indexed[host] = true
+			idx.exact[host] = append(idx.exact[host], ingressMatch{ing: i, rule: r})
+		}
+	}
+	return idx, nil
+}
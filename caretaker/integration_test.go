@@ -0,0 +1,159 @@
+//go:build integration
+
+package caretaker
+
+// The fake clientset performs no API validation, so bugs like
+// annotation keys containing "/" or malformed source ranges only
+// surface against a real control plane. This suite exercises the full
+// add -> expire -> remove flow through the public functions against
+// whatever cluster KUBECONFIG points at. controller-runtime's envtest
+// is not in the vendor tree, so the suite does not start an apiserver
+// itself: point KUBECONFIG at a disposable control plane (envtest's
+// kubebuilder assets started by hand, kind, minikube) and run
+//
+//	go test -tags integration ./caretaker/
+//
+// Fixtures are created in a dedicated namespace that is deleted again
+// afterwards. The suite skips, rather than fails, when no cluster is
+// reachable.
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
+	api_v1 "k8s.io/client-go/pkg/api/v1"
+	ext_v1 "k8s.io/client-go/pkg/apis/extensions/v1beta1"
+)
+
+const integrationDomain = "it.example.com"
+
+func integrationClientset(t *testing.T) *kubernetes.Clientset {
+	clientset, err := getClientsetExternal()
+	if err != nil {
+		t.Skipf("no kubeconfig available: %s", err)
+	}
+	if _, err := clientset.Discovery().ServerVersion(); err != nil {
+		t.Skipf("no API server reachable: %s", err)
+	}
+	return clientset
+}
+
+// setupIntegrationFixtures creates a namespace holding a managed
+// controller service and an ingress for integrationDomain, and returns
+// the namespace name with a cleanup function.
+func setupIntegrationFixtures(t *testing.T, clientset *kubernetes.Clientset) (string, func()) {
+	ns := fmt.Sprintf("caretaker-it-%d", time.Now().UnixNano())
+	_, err := clientset.CoreV1().Namespaces().Create(&api_v1.Namespace{
+		ObjectMeta: meta_v1.ObjectMeta{Name: ns},
+	})
+	if err != nil {
+		t.Fatalf("failed to create namespace: %s", err)
+	}
+	cleanup := func() {
+		if err := clientset.CoreV1().Namespaces().Delete(ns, &meta_v1.DeleteOptions{}); err != nil {
+			t.Logf("failed to delete namespace %s: %s", ns, err)
+		}
+	}
+	_, err = clientset.CoreV1().Services(ns).Create(&api_v1.Service{
+		ObjectMeta: meta_v1.ObjectMeta{
+			Name:        "ingress-nginx",
+			Annotations: map[string]string{defaultMgmtAnnotation: "true"},
+		},
+		Spec: api_v1.ServiceSpec{
+			Type:  api_v1.ServiceTypeLoadBalancer,
+			Ports: []api_v1.ServicePort{{Port: 80}},
+		},
+	})
+	if err != nil {
+		cleanup()
+		t.Fatalf("failed to create controller service: %s", err)
+	}
+	_, err = clientset.ExtensionsV1beta1().Ingresses(ns).Create(&ext_v1.Ingress{
+		ObjectMeta: meta_v1.ObjectMeta{Name: "it-ingress"},
+		Spec: ext_v1.IngressSpec{
+			Rules: []ext_v1.IngressRule{{
+				Host: integrationDomain,
+				IngressRuleValue: ext_v1.IngressRuleValue{
+					HTTP: &ext_v1.HTTPIngressRuleValue{
+						Paths: []ext_v1.HTTPIngressPath{{
+							Backend: ext_v1.IngressBackend{
+								ServiceName: "backend",
+								ServicePort: intstr.FromInt(80),
+							},
+						}},
+					},
+				},
+			}},
+		},
+	})
+	if err != nil {
+		cleanup()
+		t.Fatalf("failed to create ingress: %s", err)
+	}
+	return ns, cleanup
+}
+
+func TestIntegrationAddExpireRemove(t *testing.T) {
+	clientset := integrationClientset(t)
+	ns, cleanup := setupIntegrationFixtures(t, clientset)
+	defer cleanup()
+	ctx := context.Background()
+
+	// A CIDR exercises the key encoding: a "/" in an annotation key is
+	// rejected by a real apiserver but not by the fake clientset.
+	data := WhitelistRequest{Domain: integrationDomain, Namespace: ns, IpAddress: "203.0.113.0/24", TTL: "5s"}
+	deadline, _, err := ApplyRequestToCluster(ctx, data)
+	if err != nil {
+		t.Fatalf("ApplyRequestToCluster returned error: %s", err)
+	}
+	service, err := clientset.CoreV1().Services(ns).Get("ingress-nginx", meta_v1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to fetch service: %s", err)
+	}
+	if !rangeInList(service.Spec.LoadBalancerSourceRanges, "203.0.113.0/24") {
+		t.Fatalf("range missing from spec after add: %v", service.Spec.LoadBalancerSourceRanges)
+	}
+	if !hasManagedAnnotation(service, "203.0.113.0/24") {
+		t.Fatalf("whitelist annotation missing after add: %v", service.ObjectMeta.Annotations)
+	}
+
+	// Wait out the deadline and run the expiry pass the worker runs.
+	expiry, err := parseDeadline(deadline)
+	if err != nil {
+		t.Fatalf("unparseable deadline %q: %s", deadline, err)
+	}
+	time.Sleep(time.Until(expiry) + time.Second)
+	if err := IterateAnnotations(ctx, service, clientset); err != nil {
+		t.Fatalf("IterateAnnotations returned error: %s", err)
+	}
+	service, err = clientset.CoreV1().Services(ns).Get("ingress-nginx", meta_v1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to fetch service: %s", err)
+	}
+	if rangeInList(service.Spec.LoadBalancerSourceRanges, "203.0.113.0/24") {
+		t.Fatalf("range still in spec after expiry: %v", service.Spec.LoadBalancerSourceRanges)
+	}
+	if hasManagedAnnotation(service, "203.0.113.0/24") {
+		t.Fatalf("annotation still present after expiry: %v", service.ObjectMeta.Annotations)
+	}
+
+	// Add again and remove on demand.
+	if _, _, err := ApplyRequestToCluster(ctx, WhitelistRequest{Domain: integrationDomain, Namespace: ns, IpAddress: "198.51.100.7"}); err != nil {
+		t.Fatalf("re-add returned error: %s", err)
+	}
+	if err := RemoveRequestFromCluster(ctx, WhitelistRequest{Domain: integrationDomain, Namespace: ns, IpAddress: "198.51.100.7"}); err != nil {
+		t.Fatalf("RemoveRequestFromCluster returned error: %s", err)
+	}
+	service, err = clientset.CoreV1().Services(ns).Get("ingress-nginx", meta_v1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to fetch service: %s", err)
+	}
+	if rangeInList(service.Spec.LoadBalancerSourceRanges, "198.51.100.7") {
+		t.Fatalf("range still in spec after removal: %v", service.Spec.LoadBalancerSourceRanges)
+	}
+}
@@ -0,0 +1,139 @@
+package caretaker
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+	api_v1 "k8s.io/client-go/pkg/api/v1"
+
+	api_errors "k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Leader election keeps the expiry sweep single-writer when several
+// replicas run: every replica serves HTTP, but only the lease holder
+// runs the reconciler. The vendored client-go predates the Lease API,
+// so the lock is a ConfigMap whose annotations record the holder and
+// its last renewal, the same scheme contemporary controllers use.
+const (
+	leaderIdentityAnnotation = "service.caretaker.leader"
+	leaderRenewAnnotation    = "service.caretaker.leader-renew"
+
+	// leaseDuration is how stale a renewal may be before another
+	// candidate may steal the lock; renewInterval is how often the
+	// holder refreshes it.
+	leaseDuration = 30 * time.Second
+	renewInterval = 10 * time.Second
+)
+
+type leaderElector struct {
+	clientset kubernetes.Interface
+	identity  string
+	name      string
+	namespace string
+}
+
+func newLeaderElector(c kubernetes.Interface) *leaderElector {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "caretaker"
+	}
+	return &leaderElector{
+		clientset: c,
+		identity:  fmt.Sprintf("%s_%d", hostname, os.Getpid()),
+		name:      cfg.LeaderLockName,
+		namespace: cfg.LeaderLockNamespace,
+	}
+}
+
+// run campaigns for the lock and calls leading while it is held.
+// leading receives a channel that closes when leadership is lost or the
+// outer stop channel closes; it must return promptly after that.
+func (l *leaderElector) run(stop <-chan struct{}, leading func(<-chan struct{})) {
+	for {
+		if l.tryAcquire() {
+			logInfof("Acquired leader lock %s/%s as %s", l.namespace, l.name, l.identity)
+			l.lead(stop, leading)
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(renewInterval):
+		}
+	}
+}
+
+// lead runs leading in the background and keeps renewing the lock,
+// returning once leadership is lost or stop closes.
+func (l *leaderElector) lead(stop <-chan struct{}, leading func(<-chan struct{})) {
+	leaderStop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		leading(leaderStop)
+	}()
+	defer func() {
+		close(leaderStop)
+		<-done
+	}()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(renewInterval):
+			if !l.tryAcquire() {
+				logWarnf("Lost leader lock %s/%s, stopping reconciler", l.namespace, l.name)
+				return
+			}
+		}
+	}
+}
+
+// tryAcquire takes or renews the lock, returning whether this replica
+// now holds it. The lock may be taken when it does not exist yet, is
+// already ours, or its last renewal is older than the lease duration.
+func (l *leaderElector) tryAcquire() bool {
+	now := time.Now().UTC().Format(time.RFC3339)
+	cm, err := l.clientset.CoreV1().ConfigMaps(l.namespace).Get(l.name, meta_v1.GetOptions{})
+	if api_errors.IsNotFound(err) {
+		cm = &api_v1.ConfigMap{
+			ObjectMeta: meta_v1.ObjectMeta{
+				Name:      l.name,
+				Namespace: l.namespace,
+				Annotations: map[string]string{
+					leaderIdentityAnnotation: l.identity,
+					leaderRenewAnnotation:    now,
+				},
+			},
+		}
+		if _, err := l.clientset.CoreV1().ConfigMaps(l.namespace).Create(cm); err != nil {
+			logDebugf("Unable to create leader lock: %s", err)
+			return false
+		}
+		return true
+	}
+	if err != nil {
+		logDebugf("Unable to read leader lock: %s", err)
+		return false
+	}
+	if cm.ObjectMeta.Annotations == nil {
+		cm.ObjectMeta.Annotations = make(map[string]string)
+	}
+	holder := cm.ObjectMeta.Annotations[leaderIdentityAnnotation]
+	if holder != "" && holder != l.identity {
+		renewed, err := time.Parse(time.RFC3339, cm.ObjectMeta.Annotations[leaderRenewAnnotation])
+		if err == nil && time.Since(renewed) < leaseDuration {
+			return false
+		}
+		logInfof("Leader lock held by %s has expired, taking over", holder)
+	}
+	cm.ObjectMeta.Annotations[leaderIdentityAnnotation] = l.identity
+	cm.ObjectMeta.Annotations[leaderRenewAnnotation] = now
+	if _, err := l.clientset.CoreV1().ConfigMaps(l.namespace).Update(cm); err != nil {
+		logDebugf("Unable to update leader lock: %s", err)
+		return false
+	}
+	return true
+}
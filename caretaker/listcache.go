@@ -0,0 +1,43 @@
+package caretaker
+
+import (
+	"sync"
+	"time"
+
+	api_v1 "k8s.io/client-go/pkg/api/v1"
+)
+
+// serviceListCache memoizes the full service list briefly, so the list
+// endpoint and other callers landing inside the TTL share one List
+// call instead of each sweeping the cluster. The TTL should stay well
+// under the reconcile interval so expiry decisions never act on stale
+// data.
+type serviceListCache struct {
+	mu      sync.Mutex
+	list    *api_v1.ServiceList
+	fetched time.Time
+	hits    uint64
+	misses  uint64
+}
+
+var svcListCache = &serviceListCache{}
+
+// get returns the cached list while it is fresh, or nil.
+func (c *serviceListCache) get(ttl time.Duration) *api_v1.ServiceList {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.list == nil || time.Since(c.fetched) > ttl {
+		c.misses++
+		return nil
+	}
+	c.hits++
+	logDebugf("Service list served from cache (%d hits, %d misses since start)", c.hits, c.misses)
+	return c.list
+}
+
+func (c *serviceListCache) put(list *api_v1.ServiceList) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.list = list
+	c.fetched = time.Now()
+}
@@ -0,0 +1,27 @@
+package caretaker
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+)
+
+// Within one process an HTTP add and a reconcile removal can race on
+// the same service: both read, modify and update, and the loser's
+// write clobbers the winner's. The per-service locks serialize those
+// read-modify-update cycles; API-level conflict retries still cover
+// races with other processes. The locks are sharded by a hash of
+// namespace/name so the table stays fixed-size; two services sharing a
+// shard merely serialize, which is harmless.
+const serviceLockShards = 32
+
+var serviceLocks [serviceLockShards]sync.Mutex
+
+// lockService locks the shard for the service and returns the unlock.
+func lockService(namespace, name string) func() {
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%s/%s", namespace, name)
+	mu := &serviceLocks[h.Sum32()%serviceLockShards]
+	mu.Lock()
+	return mu.Unlock
+}
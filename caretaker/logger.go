@@ -0,0 +1,62 @@
+package caretaker
+
+import (
+	"log"
+	"os"
+	"strings"
+)
+
+const envLogLevel = "CARETAKER_LOG_LEVEL"
+
+// Log levels, in increasing order of severity.
+const (
+	levelDebug = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var (
+	logLevel = levelInfo
+	stdlog   = log.New(os.Stdout, "", log.LstdFlags)
+)
+
+// initLogger sets the log level from CARETAKER_LOG_LEVEL. Valid values
+// are debug, info, warn and error; anything else leaves the default of
+// info in place.
+func initLogger() {
+	switch strings.ToLower(os.Getenv(envLogLevel)) {
+	case "debug":
+		logLevel = levelDebug
+	case "info":
+		logLevel = levelInfo
+	case "warn":
+		logLevel = levelWarn
+	case "error":
+		logLevel = levelError
+	}
+}
+
+func logDebugf(format string, args ...interface{}) {
+	if logLevel <= levelDebug {
+		stdlog.Printf("[DEBUG] "+format, args...)
+	}
+}
+
+func logInfof(format string, args ...interface{}) {
+	if logLevel <= levelInfo {
+		stdlog.Printf("[INFO] "+format, args...)
+	}
+}
+
+func logWarnf(format string, args ...interface{}) {
+	if logLevel <= levelWarn {
+		stdlog.Printf("[WARN] "+format, args...)
+	}
+}
+
+func logErrorf(format string, args ...interface{}) {
+	if logLevel <= levelError {
+		stdlog.Printf("[ERROR] "+format, args...)
+	}
+}
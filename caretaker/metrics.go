@@ -0,0 +1,166 @@
+package caretaker
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// metricsRegistry tracks the counters and gauges exposed on /metrics.
+// The values are written out in the Prometheus text format by hand to
+// avoid pulling the client library into the vendor tree.
+type metricsRegistry struct {
+	mu                   sync.Mutex
+	activeRules          int
+	rulesNearExpiry      int
+	servicesInBackoff    int
+	servicesWithEntries  int
+	reconcileRunsTotal   uint64
+	reconcileErrorsTotal uint64
+	rulesAddedTotal      uint64
+	rulesRemovedTotal    uint64
+	lastReconcile        time.Time
+	// Hand-rolled histogram of per-service reconcile durations, in
+	// seconds. durationCounts holds per-bucket (non-cumulative)
+	// counts; the text format accumulates them on the way out.
+	durationCounts [len(durationBuckets) + 1]uint64
+	durationSum    float64
+	durationCount  uint64
+}
+
+// durationBuckets are the upper bounds of the reconcile-duration
+// histogram, chosen around the expected per-service cost of a few API
+// round trips.
+var durationBuckets = [...]float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60}
+
+var metrics = &metricsRegistry{}
+
+func (m *metricsRegistry) setActiveRules(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.activeRules = n
+}
+
+// setRulesNearExpiry records how many rules are within the configured
+// window of their deadline.
+func (m *metricsRegistry) setRulesNearExpiry(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rulesNearExpiry = n
+}
+
+// setServicesWithEntries records how many managed services currently
+// carry at least one whitelist entry.
+func (m *metricsRegistry) setServicesWithEntries(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.servicesWithEntries = n
+}
+
+// setServicesInBackoff records how many services are waiting out a
+// reconcile-failure backoff delay.
+func (m *metricsRegistry) setServicesInBackoff(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.servicesInBackoff = n
+}
+
+// observeReconcileDuration records how long one service's reconcile
+// pass took.
+func (m *metricsRegistry) observeReconcileDuration(d time.Duration) {
+	seconds := d.Seconds()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	slot := len(durationBuckets)
+	for i, le := range durationBuckets {
+		if seconds <= le {
+			slot = i
+			break
+		}
+	}
+	m.durationCounts[slot]++
+	m.durationSum += seconds
+	m.durationCount++
+}
+
+func (m *metricsRegistry) incReconcileRuns() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reconcileRunsTotal++
+}
+
+// setLastReconcile records when a reconcile pass last completed, so
+// staleness shows up on /metrics when the loop wedges.
+func (m *metricsRegistry) setLastReconcile(t time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastReconcile = t
+}
+
+func (m *metricsRegistry) incReconcileErrors() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reconcileErrorsTotal++
+}
+
+func (m *metricsRegistry) incRulesAdded() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rulesAddedTotal++
+}
+
+func (m *metricsRegistry) incRulesRemoved() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rulesRemovedTotal++
+}
+
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintf(w, "# HELP caretaker_active_rules Number of whitelist rules currently applied to managed services.\n")
+	fmt.Fprintf(w, "# TYPE caretaker_active_rules gauge\n")
+	fmt.Fprintf(w, "caretaker_active_rules %d\n", metrics.activeRules)
+	fmt.Fprintf(w, "# HELP caretaker_rules_near_expiry Number of whitelist rules within the configured window of their deadline.\n")
+	fmt.Fprintf(w, "# TYPE caretaker_rules_near_expiry gauge\n")
+	fmt.Fprintf(w, "caretaker_rules_near_expiry %d\n", metrics.rulesNearExpiry)
+	fmt.Fprintf(w, "# HELP caretaker_services_with_entries Number of managed services with at least one active whitelist entry.\n")
+	fmt.Fprintf(w, "# TYPE caretaker_services_with_entries gauge\n")
+	fmt.Fprintf(w, "caretaker_services_with_entries %d\n", metrics.servicesWithEntries)
+	fmt.Fprintf(w, "# HELP caretaker_services_in_backoff Number of services whose reconciliation is delayed by failure backoff.\n")
+	fmt.Fprintf(w, "# TYPE caretaker_services_in_backoff gauge\n")
+	fmt.Fprintf(w, "caretaker_services_in_backoff %d\n", metrics.servicesInBackoff)
+	fmt.Fprintf(w, "# HELP caretaker_reconcile_runs_total Number of reconcile sweeps started.\n")
+	fmt.Fprintf(w, "# TYPE caretaker_reconcile_runs_total counter\n")
+	fmt.Fprintf(w, "caretaker_reconcile_runs_total %d\n", metrics.reconcileRunsTotal)
+	fmt.Fprintf(w, "# HELP caretaker_reconcile_errors_total Number of errors encountered during reconcile sweeps.\n")
+	fmt.Fprintf(w, "# TYPE caretaker_reconcile_errors_total counter\n")
+	fmt.Fprintf(w, "caretaker_reconcile_errors_total %d\n", metrics.reconcileErrorsTotal)
+	fmt.Fprintf(w, "# HELP caretaker_rules_added_total Number of whitelist rules added.\n")
+	fmt.Fprintf(w, "# TYPE caretaker_rules_added_total counter\n")
+	fmt.Fprintf(w, "caretaker_rules_added_total %d\n", metrics.rulesAddedTotal)
+	fmt.Fprintf(w, "# HELP caretaker_rules_removed_total Number of whitelist rules removed, by expiry or on demand.\n")
+	fmt.Fprintf(w, "# TYPE caretaker_rules_removed_total counter\n")
+	fmt.Fprintf(w, "caretaker_rules_removed_total %d\n", metrics.rulesRemovedTotal)
+	fmt.Fprintf(w, "# HELP caretaker_reconcile_duration_seconds Time taken to reconcile one service.\n")
+	fmt.Fprintf(w, "# TYPE caretaker_reconcile_duration_seconds histogram\n")
+	cumulative := uint64(0)
+	for i, le := range durationBuckets {
+		cumulative += metrics.durationCounts[i]
+		fmt.Fprintf(w, "caretaker_reconcile_duration_seconds_bucket{le=%q} %d\n", strconv.FormatFloat(le, 'g', -1, 64), cumulative)
+	}
+	fmt.Fprintf(w, "caretaker_reconcile_duration_seconds_bucket{le=\"+Inf\"} %d\n", metrics.durationCount)
+	fmt.Fprintf(w, "caretaker_reconcile_duration_seconds_sum %g\n", metrics.durationSum)
+	fmt.Fprintf(w, "caretaker_reconcile_duration_seconds_count %d\n", metrics.durationCount)
+	if !metrics.lastReconcile.IsZero() {
+		fmt.Fprintf(w, "# HELP caretaker_last_reconcile_timestamp_seconds Unix time of the last completed reconcile.\n")
+		fmt.Fprintf(w, "# TYPE caretaker_last_reconcile_timestamp_seconds gauge\n")
+		fmt.Fprintf(w, "caretaker_last_reconcile_timestamp_seconds %d\n", metrics.lastReconcile.Unix())
+		fmt.Fprintf(w, "# HELP caretaker_reconcile_lag_seconds Seconds since the last completed reconcile.\n")
+		fmt.Fprintf(w, "# TYPE caretaker_reconcile_lag_seconds gauge\n")
+		fmt.Fprintf(w, "caretaker_reconcile_lag_seconds %.0f\n", time.Since(metrics.lastReconcile).Seconds())
+	}
+}
@@ -0,0 +1,111 @@
+package caretaker
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"k8s.io/client-go/kubernetes"
+	api_v1 "k8s.io/client-go/pkg/api/v1"
+)
+
+// When the stored value format changes (deadline serialization, new
+// fields, a new annotation prefix), old entries keep working because
+// the readers tolerate every historical format. The migrate command
+// exists so that tolerance does not have to last forever: it rewrites
+// every managed annotation into the current format in one pass, after
+// which old-format support can eventually be dropped. Rewriting an
+// already-current value is a no-op, so the command is idempotent and
+// safe to run repeatedly.
+
+// MigrateAnnotationValues rewrites the whitelist annotations of every
+// managed service into the current key prefix and value format. It
+// returns how many services were rewritten and how many were already
+// current.
+func MigrateAnnotationValues(ctx context.Context, c kubernetes.Interface) (int, int, error) {
+	services, err := GetServiceList(ctx, c)
+	if err != nil {
+		return 0, 0, err
+	}
+	migrated, skipped := 0, 0
+	for i := range services.Items {
+		s := &services.Items[i]
+		if !IsAutoManaged(s) {
+			continue
+		}
+		if !annotationsNeedMigration(s) {
+			skipped++
+			continue
+		}
+		if cfg.DryRun {
+			logInfof("Dry-run: would migrate annotations on service %s/%s", s.ObjectMeta.Namespace, s.ObjectMeta.Name)
+			migrated++
+			continue
+		}
+		err := updateServiceWithRetry(ctx, s, c, func(svc *api_v1.Service) error {
+			migrateAnnotations(svc)
+			return nil
+		})
+		if err != nil {
+			return migrated, skipped, fmt.Errorf("migrating service %s/%s: %s", s.ObjectMeta.Namespace, s.ObjectMeta.Name, err)
+		}
+		migrated++
+	}
+	logInfof("Annotation migration complete: %d services rewritten, %d already current", migrated, skipped)
+	return migrated, skipped, nil
+}
+
+// rewriteAnnotationValue round-trips a stored value through the
+// current serialization. Unparseable deadlines are left as they are
+// rather than corrupted.
+func rewriteAnnotationValue(raw string) string {
+	v := parseAnnotationValue(raw)
+	if t, err := parseDeadline(v.Deadline); err == nil {
+		v.Deadline = formatDeadline(t)
+	}
+	return formatAnnotationValue(v)
+}
+
+// migrateAnnotations rewrites the service's whitelist annotations in
+// place and reports whether anything changed. Legacy-prefix keys move
+// to the current prefix.
+func migrateAnnotations(s *api_v1.Service) bool {
+	updates := map[string]string{}
+	var removals []string
+	for key, raw := range s.ObjectMeta.Annotations {
+		prefix, ok := matchAnnotationPrefix(key)
+		if !ok {
+			continue
+		}
+		suffix := strings.TrimPrefix(key, fmt.Sprintf("%s.", prefix))
+		newKey := fmt.Sprintf("%s.%s", cfg.AnnotationKeyPrefix, suffix)
+		newValue := rewriteAnnotationValue(raw)
+		if newKey == key && newValue == raw {
+			continue
+		}
+		if newKey != key {
+			removals = append(removals, key)
+		}
+		updates[newKey] = newValue
+	}
+	for _, key := range removals {
+		delete(s.ObjectMeta.Annotations, key)
+	}
+	for key, value := range updates {
+		s.ObjectMeta.Annotations[key] = value
+	}
+	return len(updates) > 0 || len(removals) > 0
+}
+
+func annotationsNeedMigration(s *api_v1.Service) bool {
+	for key, raw := range s.ObjectMeta.Annotations {
+		prefix, ok := matchAnnotationPrefix(key)
+		if !ok {
+			continue
+		}
+		if prefix != cfg.AnnotationKeyPrefix || rewriteAnnotationValue(raw) != raw {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,150 @@
+package caretaker
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"k8s.io/client-go/kubernetes"
+	ext_v1 "k8s.io/client-go/pkg/apis/extensions/v1beta1"
+
+	api_errors "k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Modern clusters serve Ingress from networking.k8s.io/v1 and have
+// removed the extensions group entirely, which the vendored client-go
+// predates. Rather than upgrading the whole vendor tree, the newer API
+// is reached through the discovery REST client with a hand-rolled
+// decode into the extensions types the rest of the code speaks. The
+// extensions group is tried first and the process sticks with
+// networking once the older group turns out to be missing.
+
+const networkingIngressBase = "/apis/networking.k8s.io/v1"
+
+// networkingIngress is the subset of a networking.k8s.io/v1 Ingress
+// that host matching and backend resolution need.
+type networkingIngress struct {
+	ObjectMeta meta_v1.ObjectMeta `json:"metadata"`
+	Spec       struct {
+		IngressClassName *string `json:"ingressClassName"`
+		Rules            []struct {
+			Host string `json:"host"`
+			HTTP *struct {
+				Paths []struct {
+					Path    string `json:"path"`
+					Backend struct {
+						Service *struct {
+							Name string `json:"name"`
+						} `json:"service"`
+					} `json:"backend"`
+				} `json:"paths"`
+			} `json:"http"`
+		} `json:"rules"`
+	} `json:"spec"`
+}
+
+type networkingIngressList struct {
+	Items []networkingIngress `json:"items"`
+}
+
+var (
+	ingressAPIMu         sync.Mutex
+	ingressAPINetworking bool
+)
+
+func networkingPreferred() bool {
+	ingressAPIMu.Lock()
+	defer ingressAPIMu.Unlock()
+	return ingressAPINetworking
+}
+
+func preferNetworking() {
+	ingressAPIMu.Lock()
+	defer ingressAPIMu.Unlock()
+	if !ingressAPINetworking {
+		logInfof("Using networking.k8s.io/v1 for ingress lookups, the extensions group is not served")
+	}
+	ingressAPINetworking = true
+}
+
+// listIngresses lists the namespace's ingresses from whichever API
+// group the cluster serves.
+func listIngresses(namespace string, c kubernetes.Interface) ([]ext_v1.Ingress, error) {
+	if !networkingPreferred() {
+		list, err := c.ExtensionsV1beta1().Ingresses(namespace).List(meta_v1.ListOptions{})
+		if err == nil {
+			return list.Items, nil
+		}
+		if !missingAPIError(err) {
+			return nil, err
+		}
+	}
+	items, err := listNetworkingIngresses(namespace, c)
+	if err != nil {
+		return nil, err
+	}
+	preferNetworking()
+	return items, nil
+}
+
+// missingAPIError reports whether the error means the API group is not
+// served, as opposed to an ordinary request failure.
+func missingAPIError(err error) bool {
+	return api_errors.IsNotFound(err) || strings.Contains(err.Error(), "could not find the requested resource")
+}
+
+func listNetworkingIngresses(namespace string, c kubernetes.Interface) ([]ext_v1.Ingress, error) {
+	rc := c.Discovery().RESTClient()
+	if rc == nil {
+		return nil, fmt.Errorf("No REST client available for networking.k8s.io lookups")
+	}
+	path := networkingIngressBase + "/ingresses"
+	if namespace != "" {
+		path = fmt.Sprintf("%s/namespaces/%s/ingresses", networkingIngressBase, namespace)
+	}
+	raw, err := rc.Get().AbsPath(path).DoRaw()
+	if err != nil {
+		return nil, err
+	}
+	var list networkingIngressList
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return nil, fmt.Errorf("Unable to decode networking.k8s.io ingress list: %s", err)
+	}
+	items := make([]ext_v1.Ingress, 0, len(list.Items))
+	for _, ni := range list.Items {
+		items = append(items, convertNetworkingIngress(ni))
+	}
+	return items, nil
+}
+
+// convertNetworkingIngress maps a networking.k8s.io/v1 Ingress onto
+// the extensions shape, including the backend service rename from
+// backend.serviceName to backend.service.name. spec.ingressClassName
+// is folded into the class annotation so the resolver keeps working.
+func convertNetworkingIngress(ni networkingIngress) ext_v1.Ingress {
+	out := ext_v1.Ingress{ObjectMeta: ni.ObjectMeta}
+	if ni.Spec.IngressClassName != nil && out.ObjectMeta.Annotations[ingressClassAnnotation] == "" {
+		if out.ObjectMeta.Annotations == nil {
+			out.ObjectMeta.Annotations = make(map[string]string)
+		}
+		out.ObjectMeta.Annotations[ingressClassAnnotation] = *ni.Spec.IngressClassName
+	}
+	for _, r := range ni.Spec.Rules {
+		rule := ext_v1.IngressRule{Host: r.Host}
+		if r.HTTP != nil {
+			http := &ext_v1.HTTPIngressRuleValue{}
+			for _, p := range r.HTTP.Paths {
+				path := ext_v1.HTTPIngressPath{Path: p.Path}
+				if p.Backend.Service != nil {
+					path.Backend.ServiceName = p.Backend.Service.Name
+				}
+				http.Paths = append(http.Paths, path)
+			}
+			rule.IngressRuleValue = ext_v1.IngressRuleValue{HTTP: http}
+		}
+		out.Spec.Rules = append(out.Spec.Rules, rule)
+	}
+	return out
+}
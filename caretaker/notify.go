@@ -0,0 +1,100 @@
+package caretaker
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// How long a single notification attempt is allowed to take before it
+// is abandoned.
+const notifyTimeout = 10 * time.Second
+
+// A notifyEvent describes a change made to a service, for consumption
+// by notifiers (webhooks, event recorders, etc).
+type notifyEvent struct {
+	Action    string `json:"action"`
+	Service   string `json:"service"`
+	Namespace string `json:"namespace"`
+	IpAddress string `json:"ipaddress"`
+	Deadline  string `json:"deadline,omitempty"`
+	Requester string `json:"requester,omitempty"`
+	Timestamp string `json:"timestamp"`
+}
+
+// A notifier delivers a notifyEvent somewhere. Implementations must be
+// safe for concurrent use.
+type notifier interface {
+	name() string
+	send(ctx context.Context, e notifyEvent) error
+}
+
+// notifyQueueSize bounds how many undelivered events may pile up when
+// a notification target is slow; beyond that events are dropped with a
+// warning rather than blocking reconciles or growing without limit.
+const notifyQueueSize = 64
+
+var (
+	notifiers       []notifier
+	notifyQueue     chan notifyEvent
+	notifyQueueOnce sync.Once
+)
+
+func registerNotifier(n notifier) {
+	notifiers = append(notifiers, n)
+}
+
+// configureNotifiers rebuilds the notifier set from the configuration.
+func configureNotifiers() {
+	notifiers = nil
+	if cfg.WebhookURL != "" {
+		registerNotifier(newWebhookNotifier(cfg.WebhookURL, cfg.WebhookSecret))
+	}
+	if cfg.SlackWebhookURL != "" {
+		registerNotifier(newSlackNotifier(cfg.SlackWebhookURL, cfg.SlackChannel))
+	}
+}
+
+// notifyAsync hands an event to the background dispatcher. Failures are
+// logged and never surfaced to the caller, so a broken notification
+// target cannot abort or delay a cluster change.
+func notifyAsync(e notifyEvent) {
+	if len(notifiers) == 0 {
+		return
+	}
+	notifyQueueOnce.Do(func() {
+		notifyQueue = make(chan notifyEvent, notifyQueueSize)
+		go notifyDispatcher()
+	})
+	if e.Timestamp == "" {
+		e.Timestamp = time.Now().UTC().Format(time.RFC3339)
+	}
+	select {
+	case notifyQueue <- e:
+	default:
+		logWarnf("Notification queue is full, dropping %s event for %s", e.Action, e.IpAddress)
+	}
+}
+
+// notifyDispatcher drains the queue, delivering each event to every
+// registered notifier in turn.
+func notifyDispatcher() {
+	for e := range notifyQueue {
+		for _, n := range notifiers {
+			deliverNotification(n, e)
+		}
+	}
+}
+
+func deliverNotification(n notifier, e notifyEvent) {
+	defer func() {
+		if r := recover(); r != nil {
+			logErrorf("Notifier %s panicked: %v", n.name(), r)
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+	if err := n.send(ctx, e); err != nil {
+		logWarnf("Notifier %s failed: %s", n.name(), err)
+	}
+}
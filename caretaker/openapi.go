@@ -0,0 +1,154 @@
+package caretaker
+
+import "net/http"
+
+// openAPISpec describes the HTTP API as an OpenAPI 3 document. It
+// lives here, next to the handlers it documents, so spec and behavior
+// change together in the same reviews.
+const openAPISpec = `{
+  "openapi": "3.0.0",
+  "info": {
+    "title": "caretaker",
+    "description": "Whitelists IP ranges on managed LoadBalancer services, with expiring entries.",
+    "version": "1.0.0"
+  },
+  "paths": {
+    "/whitelist": {
+      "post": {
+        "summary": "Whitelist an IP range for a domain",
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {
+              "schema": {"$ref": "#/components/schemas/WhitelistRequest"}
+            }
+          }
+        },
+        "responses": {
+          "200": {
+            "description": "The range was whitelisted",
+            "content": {
+              "application/json": {
+                "schema": {"$ref": "#/components/schemas/WhitelistResponse"}
+              }
+            }
+          },
+          "400": {"description": "Invalid request"},
+          "403": {"description": "Requester not authorized for the service"},
+          "404": {"description": "No ingress found for the domain"}
+        },
+        "security": [{"bearerAuth": []}]
+      },
+      "delete": {
+        "summary": "Remove a whitelisted IP range",
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {
+              "schema": {"$ref": "#/components/schemas/WhitelistRequest"}
+            }
+          }
+        },
+        "responses": {
+          "200": {
+            "description": "The range was removed",
+            "content": {
+              "application/json": {
+                "schema": {"$ref": "#/components/schemas/WhitelistResponse"}
+              }
+            }
+          },
+          "400": {"description": "Invalid request"},
+          "404": {"description": "The range is not whitelisted"}
+        },
+        "security": [{"bearerAuth": []}]
+      }
+    },
+    "/list": {
+      "get": {
+        "summary": "List whitelist entries across managed services",
+        "responses": {
+          "200": {
+            "description": "The current whitelist entries",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "type": "array",
+                  "items": {"$ref": "#/components/schemas/WhitelistEntry"}
+                }
+              }
+            }
+          }
+        },
+        "security": [{"bearerAuth": []}]
+      }
+    }
+  },
+  "components": {
+    "securitySchemes": {
+      "bearerAuth": {"type": "http", "scheme": "bearer"}
+    },
+    "schemas": {
+      "WhitelistRequest": {
+        "type": "object",
+        "properties": {
+          "domain": {"type": "string", "description": "Domain whose ingress fronts the service to modify"},
+          "service": {"type": "string", "description": "LoadBalancer service to target directly, for TCP/UDP services without an ingress; requires namespace"},
+          "ipaddress": {"type": "string", "description": "IP or CIDR to whitelist; defaults to the caller's address"},
+          "ipaddresses": {"type": "array", "items": {"type": "string"}, "description": "Several ranges to whitelist in one request"},
+          "namespace": {"type": "string", "description": "Narrows the ingress lookup to one namespace"},
+          "cluster": {"type": "string", "description": "Named cluster to target, for instances fronting several"},
+          "ticket": {"type": "string", "description": "Reference ID for the request"},
+          "reason": {"type": "string", "description": "Justification for the request, stored with the entry"},
+          "subnet": {"type": "boolean", "description": "On removal, revoke every managed range contained in the CIDR"},
+          "controllerService": {"type": "string", "description": "Controller service to modify as namespace/name, skipping discovery"},
+          "allMatches": {"type": "boolean", "description": "Apply to every controller service whose ingress serves the domain"},
+          "ttl": {"type": "string", "description": "Lifetime for the entry, e.g. 4h, 3d or 1w"}
+        }
+      },
+      "WhitelistResponse": {
+        "type": "object",
+        "properties": {
+          "status": {"type": "string"},
+          "deadline": {"type": "string", "format": "date-time"},
+          "deadline_local": {"type": "string", "format": "date-time"},
+          "expires_in": {"type": "string"},
+          "renewals_remaining": {"type": "integer", "description": "Renewals left before the entry must fully expire, when a limit is configured"},
+          "removed": {"type": "array", "items": {"type": "string"}},
+          "results": {
+            "type": "array",
+            "items": {"$ref": "#/components/schemas/BulkResult"}
+          }
+        }
+      },
+      "BulkResult": {
+        "type": "object",
+        "properties": {
+          "ipaddress": {"type": "string"},
+          "status": {"type": "string"},
+          "deadline": {"type": "string", "format": "date-time"}
+        }
+      },
+      "WhitelistEntry": {
+        "type": "object",
+        "properties": {
+          "service": {"type": "string"},
+          "namespace": {"type": "string"},
+          "ipaddress": {"type": "string"},
+          "deadline": {"type": "string", "format": "date-time"},
+          "requester": {"type": "string"},
+          "reason": {"type": "string"},
+          "renewals": {"type": "integer"},
+          "renewals_remaining": {"type": "integer"}
+        }
+      }
+    }
+  }
+}
+`
+
+// serveOpenAPI publishes the API contract for other teams' tooling.
+func serveOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(openAPISpec))
+}
@@ -0,0 +1,129 @@
+package caretaker
+
+import (
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+	api_v1 "k8s.io/client-go/pkg/api/v1"
+
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The target policy is a coarse allow-list of what the whitelist API
+// may modify: glob patterns on the requested domain and labels on the
+// resolved service. It is not a replacement for RBAC, but it lets the
+// endpoint be exposed to app teams without handing them every
+// production service. An empty policy allows everything, preserving
+// the default behavior.
+const (
+	// policyDomainsKey and policyLabelsKey are the ConfigMap data keys
+	// the policy is read from: comma- or newline-separated domain
+	// globs, and "key=value" label lines respectively.
+	policyDomainsKey = "allowedDomains"
+	policyLabelsKey  = "allowedServiceLabels"
+	// policyRefreshInterval is how long a fetched ConfigMap policy is
+	// reused before re-reading, so changes apply without a redeploy.
+	policyRefreshInterval = time.Minute
+)
+
+type targetPolicy struct {
+	domains []string
+	labels  map[string]string
+}
+
+func (p targetPolicy) empty() bool {
+	return len(p.domains) == 0 && len(p.labels) == 0
+}
+
+var policyCache struct {
+	mu      sync.Mutex
+	policy  targetPolicy
+	fetched time.Time
+}
+
+// loadTargetPolicy merges the static environment patterns with the
+// policy ConfigMap. Fetch failures fall back to the last known policy
+// rather than silently allowing everything.
+func loadTargetPolicy(c kubernetes.Interface) targetPolicy {
+	policy := targetPolicy{domains: cfg.AllowedDomains}
+	if cfg.PolicyConfigMap == "" {
+		return policy
+	}
+	policyCache.mu.Lock()
+	defer policyCache.mu.Unlock()
+	if time.Since(policyCache.fetched) <= policyRefreshInterval {
+		return policyCache.policy
+	}
+	parts := strings.SplitN(cfg.PolicyConfigMap, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		logWarnf("Invalid %s value %q, expected namespace/name", envPolicyConfigMap, cfg.PolicyConfigMap)
+		return policy
+	}
+	cm, err := c.CoreV1().ConfigMaps(parts[0]).Get(parts[1], meta_v1.GetOptions{})
+	if err != nil {
+		logWarnf("Unable to read policy ConfigMap %s: %s", cfg.PolicyConfigMap, err)
+		if !policyCache.fetched.IsZero() {
+			return policyCache.policy
+		}
+		return policy
+	}
+	policy.domains = append(policy.domains, splitPolicyList(cm.Data[policyDomainsKey])...)
+	policy.labels = parsePolicyLabels(cm.Data[policyLabelsKey])
+	policyCache.policy = policy
+	policyCache.fetched = time.Now()
+	return policy
+}
+
+// splitPolicyList accepts comma- or newline-separated values.
+func splitPolicyList(v string) []string {
+	var out []string
+	for _, item := range strings.FieldsFunc(v, func(r rune) bool { return r == ',' || r == '\n' }) {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+func parsePolicyLabels(v string) map[string]string {
+	labels := make(map[string]string)
+	for _, line := range splitPolicyList(v) {
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			logWarnf("Ignoring malformed policy label %q, expected key=value", line)
+			continue
+		}
+		labels[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return labels
+}
+
+// checkTargetAllowed enforces the allow-list before any modification:
+// the request's domain must match a configured glob, or the resolved
+// service must carry one of the allowed labels. Out-of-scope targets
+// get a 403.
+func checkTargetAllowed(data WhitelistRequest, s *api_v1.Service, c kubernetes.Interface) error {
+	policy := loadTargetPolicy(c)
+	if policy.empty() {
+		return nil
+	}
+	for _, pattern := range policy.domains {
+		if data.Domain == "" {
+			break
+		}
+		if ok, err := path.Match(pattern, data.Domain); err == nil && ok {
+			return nil
+		}
+	}
+	for key, want := range policy.labels {
+		if s.ObjectMeta.Labels[key] == want {
+			return nil
+		}
+	}
+	logWarnf("Target %s/%s (domain %q) is outside the configured allow-list", s.ObjectMeta.Namespace, s.ObjectMeta.Name, data.Domain)
+	return errNotAuthorized
+}
@@ -0,0 +1,51 @@
+package caretaker
+
+import (
+	"net"
+	"net/http"
+	"sync"
+
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+// rateLimiters hands out one token bucket per client IP, created on
+// first use.
+type rateLimiters struct {
+	mu       sync.Mutex
+	limiters map[string]flowcontrol.RateLimiter
+}
+
+var mutationLimiters = &rateLimiters{limiters: make(map[string]flowcontrol.RateLimiter)}
+
+func (rl *rateLimiters) allow(ip string) bool {
+	if cfg.RateLimitQPS <= 0 {
+		return true
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	l, ok := rl.limiters[ip]
+	if !ok {
+		l = flowcontrol.NewTokenBucketRateLimiter(cfg.RateLimitQPS, cfg.RateLimitBurst)
+		rl.limiters[ip] = l
+	}
+	return l.TryAccept()
+}
+
+// rateLimit rejects mutating requests from clients that exceed the
+// configured per-source-IP rate.
+func rateLimit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost || r.Method == http.MethodDelete {
+			host, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				host = r.RemoteAddr
+			}
+			if !mutationLimiters.allow(host) {
+				logWarnf("Rate limit exceeded for %s", host)
+				http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,93 @@
+package caretaker
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"k8s.io/client-go/kubernetes"
+	authorization_v1 "k8s.io/client-go/pkg/apis/authorization/v1"
+)
+
+// The RBAC self-check turns a missing permission into a clear message
+// at startup instead of a cryptic client-go error on the first request
+// or reconcile. Each required verb/resource pair is asked of the API
+// server with a SelfSubjectAccessReview; by default missing
+// permissions only warn, CARETAKER_RBAC_STRICT additionally fails the
+// readiness probe until they are granted.
+type rbacCheck struct {
+	verb     string
+	group    string
+	resource string
+}
+
+var requiredPermissions = []rbacCheck{
+	{verb: "list", resource: "services"},
+	{verb: "get", resource: "services"},
+	{verb: "update", resource: "services"},
+	{verb: "list", group: "extensions", resource: "ingresses"},
+}
+
+var rbacState struct {
+	mu      sync.Mutex
+	missing []string
+}
+
+// validateRBAC verifies the credentials can do what caretaker needs in
+// every watched namespace and records what is missing.
+func validateRBAC(c kubernetes.Interface) {
+	var missing []string
+	for _, namespace := range watchNamespaces() {
+		for _, check := range requiredPermissions {
+			review := &authorization_v1.SelfSubjectAccessReview{
+				Spec: authorization_v1.SelfSubjectAccessReviewSpec{
+					ResourceAttributes: &authorization_v1.ResourceAttributes{
+						Namespace: namespace,
+						Verb:      check.verb,
+						Group:     check.group,
+						Resource:  check.resource,
+					},
+				},
+			}
+			result, err := c.AuthorizationV1().SelfSubjectAccessReviews().Create(review)
+			if err != nil {
+				logWarnf("Unable to verify RBAC permission to %s %s: %s", check.verb, check.resource, err)
+				continue
+			}
+			if !result.Status.Allowed {
+				scope := namespace
+				if scope == "" {
+					scope = "all namespaces"
+				}
+				missing = append(missing, fmt.Sprintf("%s %s in %s", check.verb, check.resource, scope))
+			}
+		}
+	}
+	rbacState.mu.Lock()
+	rbacState.missing = missing
+	rbacState.mu.Unlock()
+	if len(missing) == 0 {
+		logInfof("RBAC self-check passed")
+		return
+	}
+	for _, m := range missing {
+		logErrorf("Missing RBAC permission: cannot %s; grant it to caretaker's service account", m)
+	}
+	if cfg.RBACStrict {
+		logErrorf("RBAC self-check failed, the readiness probe will fail until the permissions are granted")
+	}
+}
+
+// rbacReadinessError reports why readiness should fail, when the
+// strict mode is on and permissions are missing.
+func rbacReadinessError() error {
+	if !cfg.RBACStrict {
+		return nil
+	}
+	rbacState.mu.Lock()
+	defer rbacState.mu.Unlock()
+	if len(rbacState.missing) == 0 {
+		return nil
+	}
+	return fmt.Errorf("missing RBAC permissions: %s", strings.Join(rbacState.missing, ", "))
+}
@@ -0,0 +1,267 @@
+package caretaker
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api"
+	api_v1 "k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+
+	api_errors "k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+)
+
+// reconciler watches services through an informer and feeds them into a
+// rate-limited work queue, replacing the old poll-the-world loop. The
+// informer's resync period doubles as the expiry-check interval, so
+// deadlines are still re-evaluated even when nothing changes.
+type reconciler struct {
+	mu        sync.Mutex
+	clientset kubernetes.Interface
+	// One store and controller per watched namespace; a single pair
+	// covering all namespaces when unscoped.
+	stores      []cache.Store
+	controllers []cache.Controller
+	queue       workqueue.RateLimitingInterface
+}
+
+func newReconciler(c kubernetes.Interface, resync time.Duration) *reconciler {
+	r := &reconciler{
+		clientset: c,
+		queue:     workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+	}
+	for _, ns := range watchNamespaces() {
+		lw := cache.NewListWatchFromClient(c.CoreV1().RESTClient(), "services", ns, fields.Everything())
+		store, controller := cache.NewInformer(lw, &api_v1.Service{}, resync, cache.ResourceEventHandlerFuncs{
+			AddFunc: r.enqueue,
+			UpdateFunc: func(old, new interface{}) {
+				r.enqueue(new)
+			},
+		})
+		r.stores = append(r.stores, store)
+		r.controllers = append(r.controllers, controller)
+	}
+	return r
+}
+
+// watchNamespaces returns the namespaces the reconciler watches: the
+// configured scope, or all namespaces when none is set.
+func watchNamespaces() []string {
+	if len(cfg.WatchNamespaces) == 0 {
+		return []string{api_v1.NamespaceAll}
+	}
+	return cfg.WatchNamespaces
+}
+
+func (r *reconciler) enqueue(obj interface{}) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		logErrorf("Unable to compute key for object: %s", err)
+		return
+	}
+	r.queue.Add(key)
+}
+
+func (r *reconciler) run(stop <-chan struct{}) {
+	defer r.queue.ShutDown()
+	for _, controller := range r.controllers {
+		go controller.Run(stop)
+	}
+	// A bounded pool drains the queue in parallel so a large number of
+	// managed services cannot delay expiry; the queue guarantees a key
+	// is never handled by two workers at once, and the worker count
+	// caps concurrent API updates.
+	workers := cfg.ReconcileWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for r.processNextItem() {
+			}
+		}()
+	}
+	<-stop
+}
+
+func (r *reconciler) processNextItem() bool {
+	key, quit := r.queue.Get()
+	if quit {
+		return false
+	}
+	defer r.queue.Done(key)
+
+	// A service still waiting out its backoff is deferred, not
+	// reconciled; resyncs would otherwise retry it at full rate.
+	if wait := backoffRemaining(key.(string)); wait > 0 {
+		r.queue.AddAfter(key, wait)
+		return true
+	}
+	start := time.Now()
+	err := r.reconcileKey(key.(string))
+	elapsed := time.Since(start)
+	metrics.observeReconcileDuration(elapsed)
+	logDebugf("Reconciled service %s in %s", key, elapsed.Round(time.Millisecond))
+	if cfg.ReconcileInterval > 0 && elapsed > cfg.ReconcileInterval {
+		logWarnf("Reconciling service %s took %s, longer than the %s interval; the controller is falling behind", key, elapsed.Round(time.Millisecond), cfg.ReconcileInterval)
+	}
+	if err != nil {
+		delay := recordBackoffFailure(key.(string))
+		logErrorf("Error reconciling service %s, next attempt in %s: %s", key, delay.Round(time.Millisecond), err)
+		metrics.incReconcileErrors()
+		if api_errors.IsUnauthorized(err) || api_errors.IsForbidden(err) {
+			r.rebuildClientset()
+		}
+		r.queue.AddAfter(key, delay)
+		return true
+	}
+	clearBackoff(key.(string))
+	r.queue.Forget(key)
+	return true
+}
+
+// reconcileKey runs the expiry check for a single service from the
+// informer's store.
+func (r *reconciler) reconcileKey(key string) error {
+	sweepGate.RLock()
+	defer sweepGate.RUnlock()
+	obj, exists, err := r.getByKey(key)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return nil
+	}
+	service, ok := obj.(*api_v1.Service)
+	if !ok || !IsAutoManaged(service) {
+		return nil
+	}
+	metrics.incReconcileRuns()
+	// Work on a copy: objects in the informer store are shared and
+	// must not be mutated.
+	copied, err := api.Scheme.DeepCopy(service)
+	if err != nil {
+		return err
+	}
+	// Bound the whole expiry pass for this service so a stuck API
+	// call cannot wedge the queue.
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.APITimeout)
+	defer cancel()
+	if err := IterateAnnotations(ctx, copied.(*api_v1.Service), r.client()); err != nil {
+		return err
+	}
+	r.updateActiveRules()
+	metrics.setLastReconcile(time.Now())
+	return nil
+}
+
+// client returns the current clientset; it may have been swapped by
+// rebuildClientset since the reconciler started.
+func (r *reconciler) client() kubernetes.Interface {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.clientset
+}
+
+// rebuildClientset replaces the cached clientset after an
+// authentication failure. The in-cluster transport re-reads the
+// service-account token on its own, but an expired external kubeconfig
+// credential needs the client rebuilt from fresh config.
+func (r *reconciler) rebuildClientset() {
+	clientset, err := GetClientset()
+	if err != nil {
+		logErrorf("Unable to rebuild clientset after authentication failure: %s", err)
+		return
+	}
+	r.mu.Lock()
+	r.clientset = clientset
+	r.mu.Unlock()
+	logInfof("Rebuilt the Kubernetes clientset after an authentication failure")
+}
+
+// getByKey looks a key up across the per-namespace stores.
+func (r *reconciler) getByKey(key string) (interface{}, bool, error) {
+	for _, store := range r.stores {
+		obj, exists, err := store.GetByKey(key)
+		if err != nil || exists {
+			return obj, exists, err
+		}
+	}
+	return nil, false, nil
+}
+
+// sweepGate coordinates manual sweeps with the scheduled ones: the
+// workers take the read side so they still run in parallel with each
+// other, while a manual sweep takes the write side and so never
+// overlaps a tick.
+var sweepGate sync.RWMutex
+
+// runManualSweep runs one full expiry pass over every managed service,
+// through the same code the worker runs, and reports how many entries
+// each service lost. It backs the /reconcile endpoint.
+func runManualSweep(ctx context.Context, c kubernetes.Interface) (map[string]int, error) {
+	sweepGate.Lock()
+	defer sweepGate.Unlock()
+	start := time.Now()
+	defer func() {
+		elapsed := time.Since(start)
+		logDebugf("Manual sweep finished in %s", elapsed.Round(time.Millisecond))
+		if cfg.ReconcileInterval > 0 && elapsed > cfg.ReconcileInterval {
+			logWarnf("Manual sweep took %s, longer than the %s reconcile interval", elapsed.Round(time.Millisecond), cfg.ReconcileInterval)
+		}
+	}()
+	services, err := GetServiceList(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	removed := make(map[string]int)
+	for i := range services.Items {
+		s := &services.Items[i]
+		if !IsAutoManaged(s) {
+			continue
+		}
+		before := countManagedAnnotations(s)
+		if err := IterateAnnotations(ctx, s, c); err != nil {
+			logErrorf("Manual sweep failed for service %s/%s: %s", s.ObjectMeta.Namespace, s.ObjectMeta.Name, err)
+			continue
+		}
+		fresh, err := c.CoreV1().Services(s.ObjectMeta.Namespace).Get(s.ObjectMeta.Name, meta_v1.GetOptions{})
+		if err != nil {
+			continue
+		}
+		if n := before - countManagedAnnotations(fresh); n > 0 {
+			removed[fmt.Sprintf("%s/%s", s.ObjectMeta.Namespace, s.ObjectMeta.Name)] = n
+		}
+	}
+	return removed, nil
+}
+
+// updateActiveRules recomputes the active-rules and near-expiry gauges
+// from the informers' stores.
+func (r *reconciler) updateActiveRules() {
+	active := 0
+	nearExpiry := 0
+	withEntries := 0
+	for _, store := range r.stores {
+		for _, obj := range store.List() {
+			s, ok := obj.(*api_v1.Service)
+			if !ok || !IsAutoManaged(s) {
+				continue
+			}
+			if n := countManagedAnnotations(s); n > 0 {
+				active += n
+				withEntries++
+			}
+			nearExpiry += countNearExpiryAnnotations(s, cfg.NearExpiryWindow)
+		}
+	}
+	metrics.setActiveRules(active)
+	metrics.setRulesNearExpiry(nearExpiry)
+	metrics.setServicesWithEntries(withEntries)
+}
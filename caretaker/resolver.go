@@ -0,0 +1,120 @@
+package caretaker
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"k8s.io/client-go/kubernetes"
+	api_v1 "k8s.io/client-go/pkg/api/v1"
+	ext_v1 "k8s.io/client-go/pkg/apis/extensions/v1beta1"
+
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const ingressClassAnnotation = "kubernetes.io/ingress.class"
+
+// A controllerResolver locates the service that fronts a given ingress,
+// so its LoadBalancerSourceRanges can be managed.
+type controllerResolver func(ing *ext_v1.Ingress, data WhitelistRequest, c kubernetes.Interface) (*api_v1.Service, error)
+
+var controllerResolvers = map[string]controllerResolver{
+	"nginx": resolveNginxController,
+}
+
+// registerControllerResolver adds support for an ingress class.
+func registerControllerResolver(class string, r controllerResolver) {
+	controllerResolvers[class] = r
+}
+
+// ingressClass reports the ingress's class. Modern clusters declare it
+// via spec.ingressClassName rather than the legacy annotation, and the
+// networking.k8s.io conversion folds that field into the annotation, so
+// reading the annotation covers both declaration styles.
+func ingressClass(ing *ext_v1.Ingress) string {
+	return ing.ObjectMeta.Annotations[ingressClassAnnotation]
+}
+
+// resolverForIngress picks the resolver matching the ingress's class.
+// Class names listed in IngressClasses are accepted as aliases for the
+// nginx resolver, for controllers deployed under a custom class.
+func resolverForIngress(ing *ext_v1.Ingress) (controllerResolver, error) {
+	class := ingressClass(ing)
+	if r, ok := controllerResolvers[class]; ok {
+		return r, nil
+	}
+	for _, accepted := range cfg.IngressClasses {
+		if class == accepted {
+			return resolveNginxController, nil
+		}
+	}
+	return nil, errBadRequest("Unsupported ingress class %q, supported classes: %s", class, strings.Join(supportedIngressClasses(), ", "))
+}
+
+func supportedIngressClasses() []string {
+	classes := make([]string, 0, len(controllerResolvers)+len(cfg.IngressClasses))
+	for class := range controllerResolvers {
+		classes = append(classes, class)
+	}
+	for _, class := range cfg.IngressClasses {
+		if _, ok := controllerResolvers[class]; !ok {
+			classes = append(classes, class)
+		}
+	}
+	sort.Strings(classes)
+	return classes
+}
+
+// nginxControllerLabels identify the Nginx ingress controller service
+// across common deployment manifests.
+var nginxControllerLabels = map[string]string{
+	"app":                    "ingress-nginx",
+	"app.kubernetes.io/name": "ingress-nginx",
+}
+
+func resolveNginxController(ing *ext_v1.Ingress, data WhitelistRequest, c kubernetes.Interface) (*api_v1.Service, error) {
+	if cfg.ControllerService != "" {
+		return getConfiguredControllerService(c)
+	}
+	// A namespace from the request narrows discovery when several
+	// controllers exist.
+	services, err := c.CoreV1().Services(data.Namespace).List(meta_v1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for i := range services.Items {
+		s := &services.Items[i]
+		if s.Spec.Type != api_v1.ServiceTypeLoadBalancer {
+			continue
+		}
+		if s.ObjectMeta.Name == "ingress-nginx" {
+			return s, nil
+		}
+		for key, want := range nginxControllerLabels {
+			if s.ObjectMeta.Labels[key] == want {
+				return s, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("No Nginx controller service found, set %s to configure one explicitly", envControllerSvc)
+}
+
+// getConfiguredControllerService fetches the service pinned by the
+// CARETAKER_CONTROLLER_SERVICE setting, given as "namespace/name".
+func getConfiguredControllerService(c kubernetes.Interface) (*api_v1.Service, error) {
+	service, err := getNamedControllerService(cfg.ControllerService, c)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid %s value %q, expected namespace/name", envControllerSvc, cfg.ControllerService)
+	}
+	return service, nil
+}
+
+// getNamedControllerService fetches a controller service referenced as
+// "namespace/name".
+func getNamedControllerService(ref string, c kubernetes.Interface) (*api_v1.Service, error) {
+	parts := strings.SplitN(ref, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, errBadRequest("Invalid controller service reference %q, expected namespace/name", ref)
+	}
+	return c.CoreV1().Services(parts[0]).Get(parts[1], meta_v1.GetOptions{})
+}
@@ -2,10 +2,22 @@ package caretaker
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
+
+	"k8s.io/client-go/kubernetes"
 )
 
 type contextKey string
@@ -13,73 +25,834 @@ type contextKey string
 type WhitelistRequest struct {
 	Domain    string `json:"domain"`
 	IpAddress string `json:"ipaddress"`
+	// Service targets a LoadBalancer service directly by name, for
+	// TCP/UDP services that have no ingress. Namespace is required
+	// alongside it; Domain is ignored when set.
+	Service string `json:"service,omitempty"`
+	// Namespace optionally narrows ingress and controller-service
+	// lookups when the same domain exists in several namespaces.
+	Namespace string `json:"namespace,omitempty"`
+	// Cluster names which configured cluster to target, for instances
+	// fronting more than one. Empty means the default cluster.
+	Cluster string `json:"cluster,omitempty"`
+	// ControllerService pins the controller service to modify, as
+	// "namespace/name", skipping discovery. The service must still be
+	// auto-managed.
+	ControllerService string `json:"controllerService,omitempty"`
+	// Ticket is a reference ID (e.g. an issue or change ticket) for
+	// the request. Required when CARETAKER_REQUIRE_TICKET is set.
+	Ticket string `json:"ticket,omitempty"`
+	// Reason is an optional justification for the request (e.g. an
+	// incident ID), stored with the entry and reported on the list
+	// endpoint and in the audit trail.
+	Reason string `json:"reason,omitempty"`
+	// TTL is an optional per-request lifetime for the entry, as a Go
+	// duration string (e.g. "4h"). Empty means the configured default.
+	TTL string `json:"ttl,omitempty"`
+	// AllMatches applies the whitelist to every controller service
+	// whose ingress serves the domain, instead of failing when the
+	// domain matches more than one.
+	AllMatches bool `json:"allMatches,omitempty"`
+	// Subnet makes a removal revoke every managed range contained in
+	// IpAddress (a CIDR), rather than the one exact entry.
+	Subnet bool `json:"subnet,omitempty"`
+	// IpAddresses allows several addresses to be whitelisted in one
+	// request. Each is applied independently and reported in the
+	// response's results.
+	IpAddresses []string `json:"ipaddresses,omitempty"`
 }
 
 type WhitelistResponse struct {
-	Deadline string
-	Status   string
+	Deadline string `json:"deadline,omitempty"`
+	// DeadlineLocal is the deadline in the server's local timezone and
+	// ExpiresIn the remaining duration, so callers need not do
+	// timezone arithmetic to know when access ends.
+	DeadlineLocal string `json:"deadline_local,omitempty"`
+	ExpiresIn     string `json:"expires_in,omitempty"`
+	Status        string `json:"status"`
+	// Removed lists the ranges revoked by a subnet-wide removal.
+	Removed []string `json:"removed,omitempty"`
+	// Matches carries the per-service outcomes of an allMatches add.
+	Matches []MatchResult `json:"matches,omitempty"`
+	// Results carries the per-address outcomes of a bulk request.
+	Results []BulkResult `json:"results,omitempty"`
+	// Errors lists the invalid fields of a rejected request, all at
+	// once, so clients can fix everything in one round trip.
+	Errors []fieldError `json:"errors,omitempty"`
+	// RenewalsRemaining is how many more times this entry may be
+	// renewed before it must fully expire, only reported when a
+	// max-renewals limit is configured.
+	RenewalsRemaining *int `json:"renewals_remaining,omitempty"`
+}
+
+// fieldError describes one invalid field in a request body.
+type fieldError struct {
+	Field string `json:"field"`
+	Error string `json:"error"`
+}
+
+// maxReasonLength bounds the reason so annotation values stay small;
+// a reason is a reference, not an essay.
+const maxReasonLength = 256
+
+// validateWhitelistRequest checks the decoded body and returns an
+// entry per invalid field rather than stopping at the first problem.
+func validateWhitelistRequest(data WhitelistRequest) []fieldError {
+	var errs []fieldError
+	if data.Service != "" {
+		if data.Namespace == "" {
+			errs = append(errs, fieldError{Field: "namespace", Error: "a namespace is required when targeting a service directly"})
+		}
+	} else if _, err := normalizeDomain(data.Domain); err != nil {
+		errs = append(errs, fieldError{Field: "domain", Error: err.Error()})
+	}
+	if data.IpAddress != "" {
+		if err := validateIpRange(data.IpAddress); err != nil {
+			errs = append(errs, fieldError{Field: "ipaddress", Error: err.Error()})
+		}
+	}
+	for _, ip := range data.IpAddresses {
+		if err := validateIpRange(ip); err != nil {
+			errs = append(errs, fieldError{Field: "ipaddresses", Error: err.Error()})
+		}
+	}
+	if data.TTL != "" {
+		if _, err := parseTTL(data.TTL); err != nil {
+			errs = append(errs, fieldError{Field: "ttl", Error: err.Error()})
+		}
+	}
+	if data.Cluster != "" {
+		if _, ok := cfg.Clusters[data.Cluster]; !ok {
+			errs = append(errs, fieldError{Field: "cluster", Error: fmt.Sprintf("unknown cluster %q", data.Cluster)})
+		}
+	}
+	if data.ControllerService != "" {
+		parts := strings.SplitN(data.ControllerService, "/", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			errs = append(errs, fieldError{Field: "controllerService", Error: "expected namespace/name"})
+		}
+	}
+	if len(data.Reason) > maxReasonLength {
+		errs = append(errs, fieldError{Field: "reason", Error: fmt.Sprintf("must be at most %d characters", maxReasonLength)})
+	}
+	if strings.ContainsAny(data.Reason, "|\n") {
+		errs = append(errs, fieldError{Field: "reason", Error: "must not contain '|' or newlines"})
+	}
+	return errs
+}
+
+// BulkResult is the outcome of one address in a bulk whitelist
+// request.
+type BulkResult struct {
+	IpAddress string `json:"ipaddress"`
+	Status    string `json:"status"`
+	Deadline  string `json:"deadline,omitempty"`
 }
 
+// apiError couples an error message with the HTTP status code it
+// should produce.
+type apiError struct {
+	status int
+	msg    string
+}
+
+func (e *apiError) Error() string { return e.msg }
+
+func errBadRequest(format string, args ...interface{}) error {
+	return &apiError{status: http.StatusBadRequest, msg: fmt.Sprintf(format, args...)}
+}
+
+func errNotFound(format string, args ...interface{}) error {
+	return &apiError{status: http.StatusNotFound, msg: fmt.Sprintf(format, args...)}
+}
+
+func errTooManyRequests(format string, args ...interface{}) error {
+	return &apiError{status: http.StatusTooManyRequests, msg: fmt.Sprintf(format, args...)}
+}
+
+func errForbidden(format string, args ...interface{}) error {
+	return &apiError{status: http.StatusForbidden, msg: fmt.Sprintf(format, args...)}
+}
+
+// httpStatusForError maps an error from the caretaker package to the
+// HTTP status code the client should see.
+func httpStatusForError(err error) int {
+	if err == errNotAuthorized {
+		return http.StatusForbidden
+	}
+	if apiErr, ok := err.(*apiError); ok {
+		return apiErr.status
+	}
+	return http.StatusInternalServerError
+}
+
+// writeJSON renders a response body with the given status code.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// shutdownTimeout bounds how long in-flight requests may take to drain
+// once a termination signal is received.
+const shutdownTimeout = 10 * time.Second
+
 const (
 	requestTimeKey = "requestTime"
+	requesterKey   = "requester"
+	requestIDKey   = "requestID"
+	reasonKey      = "reason"
+
+	// requesterHeader carries the identity of the caller making a
+	// whitelist request.
+	requesterHeader = "X-Caretaker-Requester"
+	// requestIDHeader carries the correlation ID for a request. A
+	// caller-supplied value is reused; otherwise one is generated. The
+	// ID is echoed back on the response and prefixed to every log line
+	// the request produces.
+	requestIDHeader = "X-Request-ID"
+)
+
+// Run modes: the HTTP API and the reconciler can be deployed as
+// separate processes, so the API scales horizontally while a single
+// (optionally leader-elected) worker owns the writes.
+const (
+	modeServer = "server"
+	modeWorker = "worker"
+	modeBoth   = "both"
 )
 
-func StartServer(interval time.Duration) {
-	go backgroundWorker(interval)
-	http.HandleFunc("/", processRequest)
-	fmt.Printf("Server is ready\n")
-	http.ListenAndServe(":8000", nil)
+// newRequestID generates a random correlation ID.
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
 }
 
-func backgroundWorker(interval time.Duration) {
-	fmt.Printf("Starting background worker\n")
-	clientset, err := GetClientset()
-	if err != nil {
-		fmt.Printf("No credentials available\n")
-	}
-	for range time.Tick(interval) {
-		fmt.Printf("Starting background cleanup task\n")
-		services := GetServiceList(clientset)
-		for _, s := range services.Items {
-			if IsAutoManaged(&s) {
-				err := IterateAnnotations(&s, clientset)
-				if err != nil {
-					fmt.Printf("%s\n", err)
+// StartServer runs the API server and background worker until a
+// termination signal arrives or the server fails, and returns the
+// process exit code.
+func StartServer() int {
+	LoadConfig()
+	runAPI := cfg.Mode != modeWorker
+	runWorker := cfg.Mode != modeServer && !cfg.ReadOnly
+	logInfof("Running in %s mode", cfg.Mode)
+	if cfg.ReadOnly {
+		logInfof("Read-only mode: mutating endpoints are disabled and the worker will not run")
+	}
+	stop := make(chan struct{})
+	workerDone := make(chan struct{})
+	if runWorker {
+		go backgroundWorker(cfg.ReconcileInterval, stop, workerDone)
+	} else {
+		close(workerDone)
+		// The API still updates services, so check its permissions
+		// too. A read-only instance never writes, so checking for
+		// write permissions would only produce spurious warnings.
+		if !cfg.ReadOnly {
+			go func() {
+				if clientset, err := GetClientset(); err == nil {
+					validateRBAC(clientset)
 				}
+			}()
+		}
+	}
+	if runAPI {
+		if cfg.AuthTokenFile != "" {
+			go watchAuthToken(stop)
+		}
+		if currentAuthToken() == "" {
+			logWarnf("No auth token configured, the whitelist endpoints are unauthenticated")
+		}
+		http.HandleFunc(cfg.EndpointPath, recoverPanics(rejectReadOnly(requireAuth(rateLimit(processRequest)))))
+		http.HandleFunc("/", recoverPanics(serveRoot))
+		http.HandleFunc("/list", recoverPanics(requireAuth(processListRequest)))
+		http.HandleFunc("/reconcile", recoverPanics(rejectReadOnly(requireAuth(processReconcileRequest))))
+		http.HandleFunc("/resolve", recoverPanics(requireAuth(processResolveRequest)))
+		http.HandleFunc("/config", recoverPanics(requireAuth(processConfigRequest)))
+		http.HandleFunc("/openapi.json", serveOpenAPI)
+	}
+	// Probes and metrics are served in every mode, so a worker-only
+	// process still answers its health checks and scrapes.
+	http.HandleFunc("/metrics", recoverPanics(serveMetrics))
+	http.HandleFunc("/healthz", serveHealthz)
+	http.HandleFunc("/readyz", serveReadyz)
+
+	// Bind before declaring readiness so a taken port or bad address
+	// fails fast instead of silently serving nothing.
+	listener, err := net.Listen("tcp", cfg.ListenAddr)
+	if err != nil {
+		logErrorf("Unable to listen on %s: %s", cfg.ListenAddr, err)
+		return 1
+	}
+	server := &http.Server{Addr: cfg.ListenAddr}
+	serveErr := make(chan error, 1)
+	go func() {
+		if cfg.TLSCertFile != "" && cfg.TLSKeyFile != "" {
+			logInfof("Server is ready, serving TLS on %s", listener.Addr())
+			serveErr <- server.ServeTLS(listener, cfg.TLSCertFile, cfg.TLSKeyFile)
+			return
+		}
+		if cfg.TLSCertFile != "" || cfg.TLSKeyFile != "" {
+			logWarnf("Both %s and %s must be set to enable TLS, serving plaintext", envTLSCert, envTLSKey)
+		}
+		logInfof("Server is ready, serving on %s", listener.Addr())
+		serveErr <- server.Serve(listener)
+	}()
+
+	// Block until we are asked to terminate or the server dies, then
+	// drain in-flight requests and stop the worker before exiting.
+	exitCode := 0
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	select {
+	case sig := <-signals:
+		logInfof("Received signal %s, shutting down", sig)
+	case err := <-serveErr:
+		// Shutdown makes Serve return ErrServerClosed, which is not a
+		// failure; anything else means the server cannot accept
+		// requests and the process must not linger half-alive.
+		logErrorf("Server failed: %s", err)
+		exitCode = 1
+	}
+	close(stop)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		logErrorf("Error during shutdown: %s", err)
+	}
+	select {
+	case <-workerDone:
+	case <-time.After(shutdownTimeout):
+		logWarnf("Timed out waiting for the background worker to stop")
+	}
+	logInfof("Shutdown complete")
+	return exitCode
+}
+
+// backgroundWorker runs the service reconciler, which watches services
+// through an informer and re-evaluates deadlines on every resync. New
+// services are picked up by the watch, so nothing depends on a startup
+// snapshot.
+func backgroundWorker(interval time.Duration, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	logInfof("Starting background worker")
+	clientset, err := GetClientset()
+	for err != nil {
+		logErrorf("No credentials available, retrying")
+		select {
+		case <-stop:
+			logInfof("Stopping background worker")
+			return
+		case <-time.After(interval):
+		}
+		clientset, err = GetClientset()
+	}
+	validateRBAC(clientset)
+	// Every configured cluster gets its own reconciler; the default
+	// cluster's runs on this goroutine as before.
+	runAll := func(stopCh <-chan struct{}) {
+		var wg sync.WaitGroup
+		for _, name := range clusterNames() {
+			c, err := GetClientsetFor(name)
+			if err != nil {
+				logErrorf("Unable to build a client for cluster %s: %s", name, err)
+				continue
+			}
+			wg.Add(1)
+			go func(name string, c kubernetes.Interface) {
+				defer wg.Done()
+				logInfof("Starting reconciler for cluster %s", name)
+				newReconciler(c, interval).run(stopCh)
+			}(name, c)
+		}
+		newReconciler(clientset, interval).run(stopCh)
+		wg.Wait()
+	}
+	if cfg.LeaderElect {
+		newLeaderElector(clientset).run(stop, runAll)
+	} else {
+		runAll(stop)
+	}
+	logInfof("Stopping background worker")
+}
+
+// recoverPanics keeps the server available when a handler hits an
+// unexpected code path: it logs the panic with a stack trace and turns
+// it into a 500 JSON response instead of a dropped connection.
+func recoverPanics(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if rec := recover(); rec != nil {
+				logErrorf("Panic serving %s %s: %v\n%s", r.Method, r.URL.Path, rec, debug.Stack())
+				writeJSON(w, http.StatusInternalServerError, WhitelistResponse{Status: "Internal server error"})
+			}
+		}()
+		next(w, r)
+	}
+}
+
+// requireAuth enforces the configured bearer token on a handler. When
+// no token is configured authentication is disabled.
+func requireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token := currentAuthToken(); token != "" {
+			header := r.Header.Get("Authorization")
+			want := fmt.Sprintf("Bearer %s", token)
+			if subtle.ConstantTimeCompare([]byte(header), []byte(want)) != 1 {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
 			}
 		}
+		next(w, r)
 	}
 }
 
+// rejectReadOnly refuses mutating handlers on a read-only instance, so
+// a deployment with read-only RBAC can expose status endpoints broadly
+// without ever attempting a write.
+func rejectReadOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if cfg.ReadOnly {
+			writeJSON(w, http.StatusForbidden, WhitelistResponse{Status: "This instance is read-only"})
+			return
+		}
+		next(w, r)
+	}
+}
+
+// serveHealthz is the liveness probe: it answers as long as the
+// process is serving requests.
+func serveHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+// serveReadyz is the readiness probe: the server is ready once cluster
+// credentials can be resolved.
+func serveReadyz(w http.ResponseWriter, r *http.Request) {
+	if _, err := GetClientset(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err := rbacReadinessError(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// ReconcileResponse summarizes a manual expiry sweep: how many entries
+// each service lost.
+type ReconcileResponse struct {
+	Status  string         `json:"status"`
+	Removed map[string]int `json:"removed,omitempty"`
+}
+
+// processReconcileRequest forces one expiry sweep immediately instead
+// of waiting for the next scheduled tick, which is useful right after
+// shortening a deadline and in integration tests.
+func processReconcileRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	clientset, err := GetClientset()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	removed, err := runManualSweep(r.Context(), clientset)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	total := 0
+	for _, n := range removed {
+		total += n
+	}
+	writeJSON(w, http.StatusOK, ReconcileResponse{
+		Status:  fmt.Sprintf("Sweep complete, %d entries removed", total),
+		Removed: removed,
+	})
+}
+
+// defaultEndpointPath is where the mutating whitelist handler lives.
+// Early versions served it on "/", which swallowed every unmatched
+// path; "/" is now an info page, with a shim for clients that still
+// mutate through it.
+const defaultEndpointPath = "/whitelist"
+
+// serveRoot answers "/" with a short index of the endpoints, forwards
+// mutations from legacy clients to the whitelist handler, and 404s
+// every other path.
+func serveRoot(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method == http.MethodPost || r.Method == http.MethodDelete {
+		logWarnf("Deprecated: whitelist mutation received on \"/\", clients should use %s", cfg.EndpointPath)
+		rejectReadOnly(requireAuth(rateLimit(processRequest)))(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintf(w, "caretaker\n\n")
+	fmt.Fprintf(w, "POST/DELETE %s  whitelist or remove an IP\n", cfg.EndpointPath)
+	fmt.Fprintf(w, "GET  /list       list current whitelist entries\n")
+	fmt.Fprintf(w, "GET  /resolve    show how a domain resolves to a service\n")
+	fmt.Fprintf(w, "POST /reconcile  run an expiry sweep now\n")
+	fmt.Fprintf(w, "GET  /openapi.json, /metrics, /healthz, /readyz\n")
+}
+
+// effectiveConfig is the subset of the running configuration exposed
+// on /config. Fields are listed explicitly so a secret can never leak
+// by accident: credentials and webhook URLs (which may embed tokens)
+// appear only as configured/not-configured booleans.
+type effectiveConfig struct {
+	Mode                     string            `json:"mode"`
+	ListenAddr               string            `json:"listen_addr"`
+	EndpointPath             string            `json:"endpoint_path"`
+	DryRun                   bool              `json:"dry_run"`
+	ReadOnly                 bool              `json:"read_only"`
+	DefaultTTL               string            `json:"default_ttl"`
+	MaxTTL                   string            `json:"max_ttl,omitempty"`
+	ClampTTL                 bool              `json:"clamp_ttl"`
+	ReconcileInterval        string            `json:"reconcile_interval"`
+	ReconcileWorkers         int               `json:"reconcile_workers"`
+	StartupGrace             string            `json:"startup_grace,omitempty"`
+	NearExpiryWindow         string            `json:"near_expiry_window,omitempty"`
+	ExpiryWarningWindow      string            `json:"expiry_warning_window,omitempty"`
+	CooldownWindow           string            `json:"cooldown_window,omitempty"`
+	APITimeout               string            `json:"api_timeout"`
+	MgmtAnnotation           string            `json:"mgmt_annotation"`
+	AnnotationKeyPrefix      string            `json:"annotation_key_prefix"`
+	LegacyAnnotationPrefixes []string          `json:"legacy_annotation_prefixes,omitempty"`
+	MaxRangesPerService      int               `json:"max_ranges_per_service,omitempty"`
+	MaxAnnotationBytes       int               `json:"max_annotation_bytes,omitempty"`
+	MaxRenewals              int               `json:"max_renewals,omitempty"`
+	WatchNamespaces          []string          `json:"watch_namespaces,omitempty"`
+	ControllerService        string            `json:"controller_service,omitempty"`
+	ApplyToRelated           bool              `json:"apply_to_related"`
+	RelatedLabel             string            `json:"related_label,omitempty"`
+	RequireTLSHost           bool              `json:"require_tls_host"`
+	RequireTicket            bool              `json:"require_ticket"`
+	EmptyRangesPolicy        string            `json:"empty_ranges_policy"`
+	PlaceholderRange         string            `json:"placeholder_range,omitempty"`
+	BaselineRanges           []string          `json:"baseline_ranges,omitempty"`
+	AllowedDomains           []string          `json:"allowed_domains,omitempty"`
+	PolicyConfigMap          string            `json:"policy_configmap,omitempty"`
+	UpdateStrategy           string            `json:"update_strategy"`
+	DeadlineFormat           string            `json:"deadline_format"`
+	DisplayLocation          string            `json:"display_location"`
+	ServiceCacheTTL          string            `json:"service_cache_ttl,omitempty"`
+	IngressCacheTTL          string            `json:"ingress_cache_ttl,omitempty"`
+	LeaderElect              bool              `json:"leader_elect"`
+	EmitEvents               bool              `json:"emit_events"`
+	PersistState             bool              `json:"persist_state"`
+	Clusters                 map[string]string `json:"clusters,omitempty"`
+	RBACStrict               bool              `json:"rbac_strict"`
+	AuditSink                string            `json:"audit_sink,omitempty"`
+	OTLPEndpoint             string            `json:"otlp_endpoint,omitempty"`
+	TLSEnabled               bool              `json:"tls_enabled"`
+	AuthTokenConfigured      bool              `json:"auth_token_configured"`
+	WebhookConfigured        bool              `json:"webhook_configured"`
+	ApprovalConfigured       bool              `json:"approval_configured"`
+	SlackConfigured          bool              `json:"slack_configured"`
+}
+
+func formatConfigDuration(d time.Duration) string {
+	if d <= 0 {
+		return ""
+	}
+	return d.String()
+}
+
+// processConfigRequest reports the configuration the instance actually
+// resolved, for debugging misconfiguration without log archaeology.
+func processConfigRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	view := effectiveConfig{
+		Mode:                     cfg.Mode,
+		ListenAddr:               cfg.ListenAddr,
+		EndpointPath:             cfg.EndpointPath,
+		DryRun:                   cfg.DryRun,
+		ReadOnly:                 cfg.ReadOnly,
+		DefaultTTL:               cfg.DefaultTTL.String(),
+		MaxTTL:                   formatConfigDuration(cfg.MaxTTL),
+		ClampTTL:                 cfg.ClampTTL,
+		ReconcileInterval:        cfg.ReconcileInterval.String(),
+		ReconcileWorkers:         cfg.ReconcileWorkers,
+		StartupGrace:             formatConfigDuration(cfg.StartupGrace),
+		NearExpiryWindow:         formatConfigDuration(cfg.NearExpiryWindow),
+		ExpiryWarningWindow:      formatConfigDuration(cfg.ExpiryWarningWindow),
+		CooldownWindow:           formatConfigDuration(cfg.CooldownWindow),
+		APITimeout:               cfg.APITimeout.String(),
+		MgmtAnnotation:           cfg.MgmtAnnotation,
+		AnnotationKeyPrefix:      cfg.AnnotationKeyPrefix,
+		LegacyAnnotationPrefixes: cfg.LegacyAnnotationPrefixes,
+		MaxRangesPerService:      cfg.MaxRangesPerService,
+		MaxAnnotationBytes:       cfg.MaxAnnotationBytes,
+		MaxRenewals:              cfg.MaxRenewals,
+		WatchNamespaces:          cfg.WatchNamespaces,
+		ControllerService:        cfg.ControllerService,
+		ApplyToRelated:           cfg.ApplyToRelated,
+		RelatedLabel:             cfg.RelatedLabel,
+		RequireTLSHost:           cfg.RequireTLSHost,
+		RequireTicket:            cfg.RequireTicket,
+		EmptyRangesPolicy:        cfg.EmptyRangesPolicy,
+		PlaceholderRange:         cfg.PlaceholderRange,
+		BaselineRanges:           cfg.BaselineRanges,
+		AllowedDomains:           cfg.AllowedDomains,
+		PolicyConfigMap:          cfg.PolicyConfigMap,
+		UpdateStrategy:           cfg.UpdateStrategy,
+		DeadlineFormat:           cfg.DeadlineFormat,
+		DisplayLocation:          cfg.DisplayLocation.String(),
+		ServiceCacheTTL:          formatConfigDuration(cfg.ServiceCacheTTL),
+		IngressCacheTTL:          formatConfigDuration(cfg.IngressCacheTTL),
+		LeaderElect:              cfg.LeaderElect,
+		EmitEvents:               cfg.EmitEvents,
+		PersistState:             cfg.PersistState,
+		Clusters:                 cfg.Clusters,
+		RBACStrict:               cfg.RBACStrict,
+		AuditSink:                cfg.AuditSink,
+		OTLPEndpoint:             cfg.OTLPEndpoint,
+		TLSEnabled:               cfg.TLSCertFile != "" && cfg.TLSKeyFile != "",
+		AuthTokenConfigured:      cfg.AuthToken != "" || cfg.AuthTokenFile != "",
+		WebhookConfigured:        cfg.WebhookURL != "",
+		ApprovalConfigured:       cfg.ApprovalURL != "",
+		SlackConfigured:          cfg.SlackWebhookURL != "",
+	}
+	writeJSON(w, http.StatusOK, view)
+}
+
+// ResolveResponse reports each step of resolving a domain to the
+// service a whitelist request would modify.
+type ResolveResponse struct {
+	Domain           string `json:"domain"`
+	Ingress          string `json:"ingress,omitempty"`
+	IngressNamespace string `json:"ingress_namespace,omitempty"`
+	MatchedHost      string `json:"matched_host,omitempty"`
+	IngressClass     string `json:"ingress_class,omitempty"`
+	Service          string `json:"service,omitempty"`
+	Namespace        string `json:"namespace,omitempty"`
+	AutoManaged      bool   `json:"auto_managed"`
+	Error            string `json:"error,omitempty"`
+}
+
+// processResolveRequest is a read-only dry-run of the resolution that
+// ApplyRequestToCluster performs, reporting how far it got and what it
+// found at each step. Nothing is modified.
+func processResolveRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	response := ResolveResponse{}
+	fail := func(err error) {
+		response.Error = err.Error()
+		writeJSON(w, httpStatusForError(err), response)
+	}
+	domain, err := normalizeDomain(r.URL.Query().Get("domain"))
+	if err != nil {
+		fail(err)
+		return
+	}
+	response.Domain = domain
+	data := WhitelistRequest{
+		Domain:    domain,
+		Namespace: r.URL.Query().Get("namespace"),
+		Cluster:   r.URL.Query().Get("cluster"),
+	}
+	clientset, err := GetClientsetFor(data.Cluster)
+	if err != nil {
+		fail(err)
+		return
+	}
+	ing, rule, err := FindIngForFqdn(r.Context(), domain, data.Namespace, clientset)
+	if err != nil {
+		fail(err)
+		return
+	}
+	response.Ingress = ing.ObjectMeta.Name
+	response.IngressNamespace = ing.ObjectMeta.Namespace
+	response.MatchedHost = rule.Host
+	response.IngressClass = ingressClass(&ing)
+	resolver, err := resolverForIngress(&ing)
+	if err != nil {
+		fail(err)
+		return
+	}
+	service, err := resolver(&ing, data, clientset)
+	if err != nil {
+		fail(err)
+		return
+	}
+	response.Service = service.ObjectMeta.Name
+	response.Namespace = service.ObjectMeta.Namespace
+	response.AutoManaged = IsAutoManaged(service)
+	writeJSON(w, http.StatusOK, response)
+}
+
+// processListRequest reports the whitelisted IPs and their deadlines
+// across all managed services.
+func processListRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	clientset, err := GetClientset()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	entries, err := ListWhitelistEntries(r.Context(), clientset)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// callerIP determines the client address for requests that omit an
+// explicit IP, preferring the first X-Forwarded-For entry set by a
+// fronting proxy.
+func callerIP(r *http.Request) string {
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		return strings.TrimSpace(strings.Split(xff, ",")[0])
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
 func processRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		writeJSON(w, http.StatusMethodNotAllowed, WhitelistResponse{Status: "Method not allowed, use POST or DELETE"})
+		return
+	}
 	val := time.Now()
 	key := contextKey(requestTimeKey)
-	ctx := context.WithValue(context.Background(), key, val)
+	// Derive from the request context so a client disconnect cancels
+	// the in-flight cluster work, and bound the whole request by the
+	// API timeout.
+	ctx := context.WithValue(r.Context(), key, val)
+	ctx, cancel := context.WithTimeout(ctx, cfg.APITimeout)
+	defer cancel()
+	ctx = context.WithValue(ctx, contextKey(requesterKey), r.Header.Get(requesterHeader))
+	requestID := r.Header.Get(requestIDHeader)
+	if requestID == "" {
+		requestID = newRequestID()
+	}
+	ctx = context.WithValue(ctx, contextKey(requestIDKey), requestID)
+	w.Header().Set(requestIDHeader, requestID)
+	ctx = traceContextFromRequest(ctx, r)
+	ctx, endSpan := startSpan(ctx, "caretaker.request", spanKindServer)
+	defer endSpan()
 
 	var (
 		data     WhitelistRequest
 		response WhitelistResponse
 	)
+	status := http.StatusOK
 
 	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
 	err := decoder.Decode(&data)
 
+	var fieldErrs []fieldError
+	if err == nil {
+		if data.IpAddress == "" && len(data.IpAddresses) == 0 {
+			data.IpAddress = callerIP(r)
+			logInfof("No IP supplied, using caller address %s", data.IpAddress)
+		}
+		fieldErrs = validateWhitelistRequest(data)
+	}
+
 	if err != nil {
-		response.Status = fmt.Sprintf("%s", err)
+		status = http.StatusBadRequest
+		response.Status = fmt.Sprintf("Invalid request body: %s", err)
+	} else if len(fieldErrs) > 0 {
+		status = http.StatusBadRequest
+		response.Status = "Invalid request"
+		response.Errors = fieldErrs
+	} else if r.Method == http.MethodDelete && data.Subnet {
+		removed, err := RemoveSubnetFromCluster(ctx, data)
+		auditMutation(ctx, "remove", data, err)
+		if err != nil {
+			status = httpStatusForError(err)
+			response.Status = fmt.Sprintf("%s", err)
+		} else {
+			response.Status = fmt.Sprintf("%d ranges within %s removed", len(removed), data.IpAddress)
+			response.Removed = removed
+		}
+	} else if r.Method == http.MethodDelete {
+		err := RemoveRequestFromCluster(ctx, data)
+		auditMutation(ctx, "remove", data, err)
+		if err != nil {
+			status = httpStatusForError(err)
+			response.Status = fmt.Sprintf("%s", err)
+		} else {
+			response.Status = fmt.Sprintf("IP %s successfully removed", data.IpAddress)
+		}
+	} else if data.AllMatches {
+		results, err := ApplyRequestToAllMatches(ctx, data)
+		auditMutation(ctx, "add", data, err)
+		if err != nil {
+			status = httpStatusForError(err)
+			response.Status = fmt.Sprintf("%s", err)
+		} else {
+			succeeded := 0
+			for _, result := range results {
+				if result.Deadline != "" {
+					succeeded++
+				}
+			}
+			response.Status = fmt.Sprintf("whitelisted on %d of %d matched services", succeeded, len(results))
+			response.Matches = results
+		}
+	} else if len(data.IpAddresses) > 0 {
+		failures := 0
+		for _, ip := range data.IpAddresses {
+			single := data
+			single.IpAddress = ip
+			single.IpAddresses = nil
+			result := BulkResult{IpAddress: ip}
+			deadline, _, err := ApplyRequestToCluster(ctx, single)
+			auditMutation(ctx, "add", single, err)
+			if err != nil {
+				failures++
+				result.Status = fmt.Sprintf("%s", err)
+			} else {
+				result.Status = "whitelisted"
+				result.Deadline = deadline
+			}
+			response.Results = append(response.Results, result)
+		}
+		response.Status = fmt.Sprintf("%d of %d addresses whitelisted", len(data.IpAddresses)-failures, len(data.IpAddresses))
 	} else {
-		deadline, err := ApplyRequestToCluster(ctx, data)
+		deadline, renewals, err := ApplyRequestToCluster(ctx, data)
+		auditMutation(ctx, "add", data, err)
 		if err != nil {
+			status = httpStatusForError(err)
 			response.Status = fmt.Sprintf("%s", err)
 		} else {
-			response.Status = fmt.Sprintf("IP successfully whitelisted until: %s", deadline)
+			response.Status = fmt.Sprintf("IP successfully whitelisted until: %s", displayDeadline(deadline))
 			response.Deadline = deadline
+			response.DeadlineLocal, response.ExpiresIn = describeDeadline(deadline)
+			response.RenewalsRemaining = renewalsRemaining(renewals)
 		}
 	}
-	jsonResponse, err := json.Marshal(response)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(jsonResponse)
+	writeJSON(w, status, response)
 }
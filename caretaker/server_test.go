@@ -0,0 +1,82 @@
+package caretaker
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"k8s.io/client-go/kubernetes"
+)
+
+// The HTTP layer and the package API drifted apart in the past, to the
+// point of not compiling together. These assertions pin the signatures
+// the handlers depend on so any future change breaks the build here,
+// with an explanation, rather than at the call sites.
+var (
+	_ func(context.Context, WhitelistRequest) (string, int, error) = ApplyRequestToCluster
+	_ func(context.Context, WhitelistRequest) error                = RemoveRequestFromCluster
+	_ func() (*kubernetes.Clientset, error)                        = GetClientset
+)
+
+func TestRecoverPanicsReturns500(t *testing.T) {
+	handler := recoverPanics(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	handler(rec, req)
+
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusInternalServerError)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", ct)
+	}
+}
+
+func TestProcessRequestValidation(t *testing.T) {
+	post := func(body string) (*httptest.ResponseRecorder, WhitelistResponse) {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		processRequest(rec, req)
+		var resp WhitelistResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("response is not valid JSON: %s", err)
+		}
+		return rec, resp
+	}
+
+	t.Run("malformed JSON", func(t *testing.T) {
+		rec, _ := post(`{"domain": `)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("status = %d, want %d", rec.Code, http.StatusBadRequest)
+		}
+	})
+
+	t.Run("unknown fields are rejected", func(t *testing.T) {
+		rec, _ := post(`{"domain": "app.example.com", "bogus": true}`)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("status = %d, want %d", rec.Code, http.StatusBadRequest)
+		}
+	})
+
+	t.Run("all invalid fields are reported together", func(t *testing.T) {
+		rec, resp := post(`{"domain": "not a domain", "ipaddress": "not-an-ip", "ttl": "soon"}`)
+		if rec.Code != http.StatusBadRequest {
+			t.Fatalf("status = %d, want %d", rec.Code, http.StatusBadRequest)
+		}
+		fields := make(map[string]bool)
+		for _, e := range resp.Errors {
+			fields[e.Field] = true
+		}
+		for _, want := range []string{"domain", "ipaddress", "ttl"} {
+			if !fields[want] {
+				t.Errorf("missing field error for %q in %v", want, resp.Errors)
+			}
+		}
+	})
+}
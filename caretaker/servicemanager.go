@@ -2,26 +2,98 @@ package caretaker
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
-	"os"
-	"path/filepath"
+	"net"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
+	"golang.org/x/net/idna"
 	"k8s.io/client-go/kubernetes"
 	api_v1 "k8s.io/client-go/pkg/api/v1"
 	ext_v1 "k8s.io/client-go/pkg/apis/extensions/v1beta1"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 
+	api_errors "k8s.io/apimachinery/pkg/api/errors"
 	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 )
 
 const (
-	mgmtAnnotation      = "service.caretaker.ipautomanaged"
-	annotationKeyPrefix = "service.caretaker.ipaddr"
+	defaultMgmtAnnotation       = "service.caretaker.ipautomanaged"
+	defaultTTLAnnotation        = "service.caretaker.defaultttl"
+	pausedAnnotation            = "service.caretaker.paused"
+	defaultAnnotationKeyPrefix  = "service.caretaker.ipaddr"
+	allowedRequestersAnnotation = "service.caretaker.allowed-requesters"
 )
 
+// annotationValue holds the fields stored in a whitelist annotation
+// value. Fields are pipe-separated and positional; entries written by
+// older versions carry only a deadline.
+type annotationValue struct {
+	Deadline  string
+	Requester string
+	// Warned records that the pre-expiry warning has fired for this
+	// entry, so it fires at most once.
+	Warned bool
+	// Reason is the caller-supplied justification for the entry, e.g.
+	// an incident ID.
+	Reason string
+	// Renewals counts how many times the entry's deadline has been
+	// extended since it was first granted.
+	Renewals int
+}
+
+func formatAnnotationValue(v annotationValue) string {
+	warned := ""
+	if v.Warned {
+		warned = "warned"
+	}
+	renewals := ""
+	if v.Renewals > 0 {
+		renewals = strconv.Itoa(v.Renewals)
+	}
+	parts := []string{v.Deadline, v.Requester, warned, v.Reason, renewals}
+	// Trailing empty fields are trimmed so values stay as short as
+	// older versions wrote them.
+	for len(parts) > 1 && parts[len(parts)-1] == "" {
+		parts = parts[:len(parts)-1]
+	}
+	return strings.Join(parts, "|")
+}
+
+func parseAnnotationValue(raw string) annotationValue {
+	parts := strings.Split(raw, "|")
+	v := annotationValue{Deadline: parts[0]}
+	if len(parts) > 1 {
+		v.Requester = parts[1]
+	}
+	if len(parts) > 2 {
+		v.Warned = parts[2] == "warned"
+	}
+	if len(parts) > 3 {
+		v.Reason = parts[3]
+	}
+	if len(parts) > 4 {
+		if n, err := strconv.Atoi(parts[4]); err == nil {
+			v.Renewals = n
+		}
+	}
+	return v
+}
+
+// legacyDeadlineLayout is the local-time deadline format written by
+// earlier versions. New deadlines are stored in UTC RFC3339, but values
+// in the old format are still honored.
+const legacyDeadlineLayout = "2006-01-02 15:04:05"
+
+// errNotAuthorized is returned when a requester is not permitted to
+// modify the target service. The server maps it to a 403 response.
+var errNotAuthorized = fmt.Errorf("Requester is not authorized for this service")
+
 func GetClientset() (*kubernetes.Clientset, error) {
 	var clientset *kubernetes.Clientset
 	var err error
@@ -40,13 +112,20 @@ func GetClientset() (*kubernetes.Clientset, error) {
 
 // For retrieving credentials outside of a Kubernetes cluster
 func getClientsetExternal() (*kubernetes.Clientset, error) {
-	kubeconfig := filepath.Join(os.Getenv("HOME"), ".kube", "config")
-
-	// Use the current context from the kubeconfig file
-	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	// The default loading rules honor KUBECONFIG, including the
+	// colon-separated list form kubectl supports, and fall back to
+	// $HOME/.kube/config. An explicit path or context from the
+	// configuration overrides both.
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	if cfg.Kubeconfig != "" {
+		rules.ExplicitPath = cfg.Kubeconfig
+	}
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: cfg.KubeContext}
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides).ClientConfig()
 	if err != nil {
 		return nil, err
 	}
+	config.Timeout = cfg.APITimeout
 
 	clientset, err := kubernetes.NewForConfig(config)
 	if err != nil {
@@ -61,6 +140,7 @@ func getClientsetInternal() (*kubernetes.Clientset, error) {
 	if err != nil {
 		return nil, err
 	}
+	config.Timeout = cfg.APITimeout
 	// creates the clientset
 	clientset, err := kubernetes.NewForConfig(config)
 	if err != nil {
@@ -69,48 +149,394 @@ func getClientsetInternal() (*kubernetes.Clientset, error) {
 	return clientset, nil
 }
 
-func FindIngForFqdn(f string, c *kubernetes.Clientset) (ext_v1.Ingress, error) {
-	opts := meta_v1.ListOptions{}
-	ingresses, err := c.ExtensionsV1beta1().Ingresses("").List(opts)
+// An ingressMatch couples an ingress with the specific rule that
+// matched the requested domain, so later steps operate on that rule
+// rather than assuming index 0.
+type ingressMatch struct {
+	ing  ext_v1.Ingress
+	rule ext_v1.IngressRule
+}
+
+// FindIngForFqdn locates the ingress serving the given fqdn and the
+// rule within it that matched. A non-empty namespace restricts the
+// search. More than one exact match across ingresses is an ambiguity
+// error: picking one silently could whitelist the wrong backend.
+func FindIngForFqdn(ctx context.Context, f string, ns string, c kubernetes.Interface) (ext_v1.Ingress, ext_v1.IngressRule, error) {
+	if err := ctx.Err(); err != nil {
+		return ext_v1.Ingress{}, ext_v1.IngressRule{}, err
+	}
+	_, endSpan := startSpan(ctx, "FindIngForFqdn", spanKindInternal)
+	defer endSpan()
+	namespaces, err := lookupNamespaces(ns)
+	if err != nil {
+		return ext_v1.Ingress{}, ext_v1.IngressRule{}, err
+	}
+	// An exact host always wins; wildcard matches are only considered
+	// when no ingress names the domain directly.
+	exact, wildcards, err := ingressIndex.lookup(f, namespaces, c)
+	if err != nil {
+		return ext_v1.Ingress{}, ext_v1.IngressRule{}, err
+	}
+	if len(exact) == 1 {
+		return exact[0].ing, exact[0].rule, nil
+	}
+	if len(exact) > 1 {
+		return ext_v1.Ingress{}, ext_v1.IngressRule{}, errBadRequest("Domain %s is served by multiple ingresses: %s", f, strings.Join(matchNames(exact), ", "))
+	}
+	switch len(wildcards) {
+	case 0:
+		return ext_v1.Ingress{}, ext_v1.IngressRule{}, errNotFound("No ingress found for domain %s", f)
+	case 1:
+		return wildcards[0].ing, wildcards[0].rule, nil
+	}
+	return ext_v1.Ingress{}, ext_v1.IngressRule{}, errBadRequest("Domain %s ambiguously matches wildcard ingresses: %s", f, strings.Join(matchNames(wildcards), ", "))
+}
+
+// findAllIngForFqdn returns every ingress serving the domain: all the
+// exact-host matches, or all the wildcard matches when no ingress
+// names the domain directly. Unlike FindIngForFqdn, multiple matches
+// are a result rather than an ambiguity error; the allMatches request
+// mode applies to each of them.
+func findAllIngForFqdn(ctx context.Context, f string, ns string, c kubernetes.Interface) ([]ingressMatch, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	namespaces, err := lookupNamespaces(ns)
+	if err != nil {
+		return nil, err
+	}
+	exact, wildcards, err := ingressIndex.lookup(f, namespaces, c)
 	if err != nil {
-		return ext_v1.Ingress{}, err
+		return nil, err
+	}
+	if len(exact) > 0 {
+		return exact, nil
+	}
+	if len(wildcards) == 0 {
+		return nil, errNotFound("No ingress found for domain %s", f)
+	}
+	return wildcards, nil
+}
+
+func matchNames(matches []ingressMatch) []string {
+	names := make([]string, 0, len(matches))
+	for _, m := range matches {
+		names = append(names, fmt.Sprintf("%s/%s", m.ing.ObjectMeta.Namespace, m.ing.ObjectMeta.Name))
+	}
+	return names
+}
+
+// backendForRule returns the single backend service the matched rule
+// routes to, or an ambiguity error when its paths point at different
+// services. A rule without HTTP paths yields nil: there is no backend
+// to disagree about.
+func backendForRule(rule ext_v1.IngressRule, domain string) (*ext_v1.IngressBackend, error) {
+	if rule.HTTP == nil || len(rule.HTTP.Paths) == 0 {
+		return nil, nil
+	}
+	backend := &rule.HTTP.Paths[0].Backend
+	for _, p := range rule.HTTP.Paths[1:] {
+		if p.Backend.ServiceName != backend.ServiceName {
+			return nil, errBadRequest("Domain %s routes to multiple backend services (%s, %s), specify the service directly", domain, backend.ServiceName, p.Backend.ServiceName)
+		}
+	}
+	return backend, nil
+}
+
+// lookupNamespaces resolves a requested namespace against the
+// configured scope: an explicit namespace must be inside the scope,
+// and an empty one expands to the whole scope (or all namespaces when
+// no scope is configured).
+func lookupNamespaces(ns string) ([]string, error) {
+	if len(cfg.WatchNamespaces) == 0 {
+		return []string{ns}, nil
+	}
+	if ns == "" {
+		return cfg.WatchNamespaces, nil
+	}
+	for _, allowed := range cfg.WatchNamespaces {
+		if allowed == ns {
+			return []string{ns}, nil
+		}
+	}
+	return nil, errBadRequest("Namespace %s is outside the configured namespace scope", ns)
+}
+
+// wildcardHostMatches reports whether a wildcard ingress host such as
+// "*.example.com" matches the domain. Per the Kubernetes host-matching
+// rules the wildcard covers exactly one left-most label, so
+// "a.example.com" matches but "a.b.example.com" and "example.com" do
+// not.
+func wildcardHostMatches(host, domain string) bool {
+	if !strings.HasPrefix(host, "*.") {
+		return false
+	}
+	parts := strings.SplitN(domain, ".", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return false
+	}
+	return parts[1] == strings.TrimPrefix(host, "*.")
+}
+
+// domainPattern matches a plausible DNS name: dot-separated labels of
+// letters, digits and hyphens, neither starting nor ending with a
+// hyphen.
+var domainPattern = regexp.MustCompile(`^([a-z0-9]([-a-z0-9]*[a-z0-9])?\.)+[a-z]{2,}$`)
+
+// normalizeDomain trims and lowercases a request domain, and rejects
+// values that are not plausible hostnames before any cluster lookups
+// happen. This gives clearer feedback than a "no ingress found" error
+// and avoids needless List calls.
+func normalizeDomain(d string) (string, error) {
+	d = normalizeHost(d)
+	if d == "" {
+		return "", errBadRequest("A domain is required")
+	}
+	if len(d) > 253 || !domainPattern.MatchString(d) {
+		return "", errBadRequest("Invalid domain %q", d)
 	}
-	for _, i := range ingresses.Items {
-		for _, r := range i.Spec.Rules {
-			if r.Host == f {
-				return i, nil
+	return d, nil
+}
+
+// normalizeHost canonicalizes a hostname for comparison: trimmed,
+// lowercased, without the optional trailing dot, and with
+// internationalized names in their punycode form. Both the requested
+// domain and the ingress hosts go through here, so an IDN or a
+// trailing-dot FQDN still matches the ingress that serves it.
+func normalizeHost(h string) string {
+	h = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(h), "."))
+	if ascii, err := idna.ToASCII(h); err == nil {
+		return ascii
+	}
+	return h
+}
+
+// validateIpRange checks that a caller-supplied value is a well-formed
+// IP address or CIDR range before it is applied to a service.
+func validateIpRange(ip string) error {
+	if ip == "" {
+		return errBadRequest("No IP address supplied")
+	}
+	if _, _, err := net.ParseCIDR(ip); err == nil {
+		return nil
+	}
+	if net.ParseIP(ip) != nil {
+		return nil
+	}
+	return errBadRequest("Invalid IP address or CIDR %q", ip)
+}
+
+// normalizeIpRange validates a caller-supplied range and returns the
+// canonical form to store. Bare IPv6 addresses become a /128 so the
+// cloud load balancer sees an explicit prefix; bare IPv4 addresses are
+// kept as-is for compatibility with existing annotations.
+func normalizeIpRange(ip string) (string, error) {
+	ip = strings.TrimSpace(ip)
+	if err := validateIpRange(ip); err != nil {
+		return "", err
+	}
+	if parsed := net.ParseIP(ip); parsed != nil && parsed.To4() == nil {
+		return fmt.Sprintf("%s/128", ip), nil
+	}
+	return ip, nil
+}
+
+// Annotation keys may only contain alphanumerics, dashes, underscores
+// and dots, so the "/" of a CIDR and the ":" of an IPv6 address must be
+// encoded in the key segment. Neither replacement character occurs in
+// a raw IP or CIDR, so the mapping reverses cleanly.
+var (
+	rangeKeyEncoder = strings.NewReplacer("/", "_", ":", "-")
+	rangeKeyDecoder = strings.NewReplacer("_", "/", "-", ":")
+)
+
+// encodeRangeKey renders a range for use as an annotation key segment.
+func encodeRangeKey(iprange string) string {
+	return rangeKeyEncoder.Replace(iprange)
+}
+
+// decodeRangeKey recovers the original range from a key segment.
+func decodeRangeKey(segment string) string {
+	return rangeKeyDecoder.Replace(segment)
+}
+
+// requesterIsAllowed checks the requester identity from the request
+// context against the service's allowed-requesters annotation, a
+// comma-separated list of identities. A service without the annotation
+// falls back to the global authorization rules.
+func requesterIsAllowed(ctx context.Context, s *api_v1.Service) bool {
+	allowed, ok := s.ObjectMeta.Annotations[allowedRequestersAnnotation]
+	if !ok {
+		return true
+	}
+	requester := requesterFromContext(ctx)
+	for _, r := range strings.Split(allowed, ",") {
+		if strings.TrimSpace(r) == requester && requester != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// requesterFromContext returns the caller identity recorded by the
+// HTTP layer, if any.
+func requesterFromContext(ctx context.Context) string {
+	requester, _ := ctx.Value(contextKey(requesterKey)).(string)
+	return requester
+}
+
+// reasonFromContext returns the justification supplied with the
+// request, if any.
+func reasonFromContext(ctx context.Context) string {
+	reason, _ := ctx.Value(contextKey(reasonKey)).(string)
+	return reason
+}
+
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(contextKey(requestIDKey)).(string)
+	return id
+}
+
+// withRequestID prefixes a log format string with the request's
+// correlation ID, so lines from one request can be grepped together.
+func withRequestID(ctx context.Context, format string) string {
+	if id := requestIDFromContext(ctx); id != "" {
+		return fmt.Sprintf("[rid=%s] %s", id, format)
+	}
+	return format
+}
+
+// ingressHasTLSHost reports whether the domain appears in any of the
+// ingress's spec.tls host lists.
+func ingressHasTLSHost(i *ext_v1.Ingress, f string) bool {
+	f = normalizeHost(f)
+	for _, tls := range i.Spec.TLS {
+		for _, h := range tls.Hosts {
+			if normalizeHost(h) == f {
+				return true
 			}
 		}
 	}
-	return ext_v1.Ingress{}, fmt.Errorf("No ingress found for domain %s", f)
+	return false
+}
+
+// IsAutoManaged reports whether the service has opted in to caretaker
+// management. Historically the annotation's presence was enough; a
+// boolean value now allows switching management off with "false"
+// without deleting the annotation.
+// isPaused reports whether the service's whitelist is frozen. A paused
+// service is still auto-managed (IsAutoManaged is unaffected, so the
+// management intent is kept), but expiry is skipped and new additions
+// are rejected until the annotation is cleared.
+func isPaused(s *api_v1.Service) bool {
+	paused, err := strconv.ParseBool(s.ObjectMeta.Annotations[pausedAnnotation])
+	return err == nil && paused
 }
 
 func IsAutoManaged(s *api_v1.Service) bool {
-	if _, ok := s.ObjectMeta.Annotations[mgmtAnnotation]; ok {
+	v, ok := s.ObjectMeta.Annotations[cfg.MgmtAnnotation]
+	if !ok {
+		return false
+	}
+	if v == "" {
 		return true
-	} else {
+	}
+	enabled, err := strconv.ParseBool(v)
+	if err != nil {
+		// Unrecognised values keep the legacy presence semantics.
+		return true
+	}
+	return enabled
+}
+
+// parseRange converts a stored source range, bare IP or CIDR, into a
+// network for containment checks. Unparseable values yield nil.
+func parseRange(r string) *net.IPNet {
+	if _, n, err := net.ParseCIDR(r); err == nil {
+		return n
+	}
+	ip := net.ParseIP(r)
+	if ip == nil {
+		return nil
+	}
+	bits := 32
+	if ip.To4() == nil {
+		bits = 128
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+}
+
+// rangeCovers reports whether the outer range wholly contains the
+// inner one. Partially overlapping ranges do not cover each other.
+func rangeCovers(outer, inner string) bool {
+	o, i := parseRange(outer), parseRange(inner)
+	if o == nil || i == nil {
 		return false
 	}
+	oOnes, oBits := o.Mask.Size()
+	iOnes, iBits := i.Mask.Size()
+	return oBits == iBits && oOnes <= iOnes && o.Contains(i.IP)
+}
+
+// coveringRange returns the first existing range that wholly covers n,
+// or empty when none does.
+func coveringRange(c []string, n string) string {
+	for _, v := range c {
+		if rangeCovers(v, n) {
+			return v
+		}
+	}
+	return ""
+}
+
+// rangesCoveredBy returns the existing entries that n supersedes.
+// Baseline ranges are never collapsed.
+func rangesCoveredBy(n string, c []string) []string {
+	var covered []string
+	for _, v := range c {
+		if v != n && !isBaselineRange(v) && rangeCovers(n, v) {
+			covered = append(covered, v)
+		}
+	}
+	return covered
 }
 
 func reconcileSourceRanges(c []string, n string, op string) ([]string, error) {
 	if op == "add" {
+		// A range already covered by an existing entry, exactly or by
+		// a broader CIDR, is a no-op here; the caller still refreshes
+		// the deadline annotation. Conversely a broader new range
+		// collapses the narrower entries it supersedes, so the spec
+		// does not accumulate redundant LB rules.
+		if coveringRange(c, n) != "" {
+			return c, nil
+		}
+		out := make([]string, 0, len(c)+1)
 		for _, v := range c {
-			if v == n {
-				return nil, fmt.Errorf("IP address %s already whitelisted", v)
+			if !isBaselineRange(v) && rangeCovers(n, v) {
+				continue
 			}
+			out = append(out, v)
 		}
-		c = append(c, n)
-		return c, nil
+		out = append(out, n)
+		return out, nil
 	}
 	if op == "remove" {
-		for i, v := range c {
+		// Build a fresh slice so the remaining ranges keep their
+		// order, and drop every occurrence in case of duplicates.
+		found := false
+		out := make([]string, 0, len(c))
+		for _, v := range c {
 			if v == n {
-				c[i] = c[0]
-				return c[1:], nil
+				found = true
+				continue
 			}
+			out = append(out, v)
 		}
-		return nil, fmt.Errorf("IP address not found.")
+		if !found {
+			return nil, errNotFound("Range %s is not in the service's source ranges", n)
+		}
+		return out, nil
 	}
 	return nil, fmt.Errorf("Unsupported operation %s", op)
 }
@@ -119,118 +545,1499 @@ func applySourceRangesToSpec(r []string, s *api_v1.Service) {
 	s.Spec.LoadBalancerSourceRanges = r
 }
 
-func UpdateServiceSpec(iprange string, ns string, s *api_v1.Service, c *kubernetes.Clientset) (string, error) {
-	ipranges, err := reconcileSourceRanges(s.Spec.LoadBalancerSourceRanges, iprange, "add")
+// updateRetries is how many times a conflicting service update is
+// retried against the latest version before giving up.
+const updateRetries = 3
+
+// Write strategies for sending service changes to the API server. A
+// full update sends the whole object and can clobber concurrent
+// changes to fields caretaker does not manage; a merge patch touches
+// only the source ranges and caretaker's annotations. Patch will
+// become the default once it has proven itself in production.
+const (
+	updateStrategyUpdate = "update"
+	updateStrategyPatch  = "patch"
+)
+
+// updateServiceWithRetry applies mutate to the service and writes it
+// back, re-fetching the latest version and reapplying the mutation if
+// the update hits an optimistic-concurrency conflict.
+func updateServiceWithRetry(ctx context.Context, s *api_v1.Service, c kubernetes.Interface, mutate func(*api_v1.Service) error) error {
+	_, endSpan := startSpan(ctx, "Services.Update", spanKindInternal)
+	defer endSpan()
+	// Serialize in-process writers to this service; every modification
+	// path funnels through here.
+	unlock := lockService(s.ObjectMeta.Namespace, s.ObjectMeta.Name)
+	defer unlock()
+	target := s
+	for attempt := 0; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		beforeAnnotations := copyAnnotations(target)
+		beforeRanges := append([]string(nil), target.Spec.LoadBalancerSourceRanges...)
+		if err := mutate(target); err != nil {
+			return err
+		}
+		var err error
+		if cfg.UpdateStrategy == updateStrategyPatch {
+			err = patchServiceChanges(beforeAnnotations, beforeRanges, target, c)
+		} else {
+			_, err = c.CoreV1().Services(target.ObjectMeta.Namespace).Update(target)
+		}
+		if err == nil {
+			return nil
+		}
+		if !api_errors.IsConflict(err) || attempt >= updateRetries {
+			return err
+		}
+		logWarnf("Conflict updating service %s/%s, retrying with the latest version", target.ObjectMeta.Namespace, target.ObjectMeta.Name)
+		fresh, getErr := c.CoreV1().Services(target.ObjectMeta.Namespace).Get(target.ObjectMeta.Name, meta_v1.GetOptions{})
+		if getErr != nil {
+			return getErr
+		}
+		target = fresh
+	}
+}
+
+func copyAnnotations(s *api_v1.Service) map[string]string {
+	out := make(map[string]string, len(s.ObjectMeta.Annotations))
+	for k, v := range s.ObjectMeta.Annotations {
+		out[k] = v
+	}
+	return out
+}
+
+// patchServiceChanges sends the difference the mutation made as a JSON
+// merge patch, so only the source ranges and the annotations caretaker
+// changed are written. The resourceVersion is included so the API
+// server still detects conflicts with concurrent writers, keeping the
+// retry loop meaningful. When the mutation changed nothing there is
+// nothing to write.
+func patchServiceChanges(beforeAnnotations map[string]string, beforeRanges []string, s *api_v1.Service, c kubernetes.Interface) error {
+	annotations := make(map[string]interface{})
+	for k, v := range s.ObjectMeta.Annotations {
+		if old, ok := beforeAnnotations[k]; !ok || old != v {
+			annotations[k] = v
+		}
+	}
+	for k := range beforeAnnotations {
+		if _, ok := s.ObjectMeta.Annotations[k]; !ok {
+			// null removes the key in a JSON merge patch.
+			annotations[k] = nil
+		}
+	}
+	rangesChanged := !stringSlicesEqual(beforeRanges, s.Spec.LoadBalancerSourceRanges)
+	if len(annotations) == 0 && !rangesChanged {
+		return nil
+	}
+	metadata := map[string]interface{}{"resourceVersion": s.ObjectMeta.ResourceVersion}
+	if len(annotations) > 0 {
+		metadata["annotations"] = annotations
+	}
+	doc := map[string]interface{}{"metadata": metadata}
+	if rangesChanged {
+		doc["spec"] = map[string]interface{}{"loadBalancerSourceRanges": s.Spec.LoadBalancerSourceRanges}
+	}
+	patch, err := json.Marshal(doc)
 	if err != nil {
-		return "", err
+		return err
 	}
-	applySourceRangesToSpec(ipranges, s)
-	deadline := updateServiceAnnotation(iprange, s)
-	_, err = c.CoreV1().Services(ns).Update(s)
+	_, err = c.CoreV1().Services(s.ObjectMeta.Namespace).Patch(s.ObjectMeta.Name, types.MergePatchType, patch)
+	return err
+}
+
+func stringSlicesEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func UpdateServiceSpec(ctx context.Context, iprange string, ns string, s *api_v1.Service, c kubernetes.Interface) (string, error) {
+	deadline := formatDeadline(time.Now().Add(serviceDefaultTTL(s)))
+	_, err := updateServiceSpecWithDeadline(ctx, iprange, ns, deadline, s, c)
 	if err != nil {
 		return "", err
 	}
 	return deadline, nil
 }
 
-func updateServiceAnnotation(iprange string, s *api_v1.Service) string {
-	now := time.Now()
-	deadline := now.AddDate(0, 0, 2).Format("2006-01-02 15:04:05")
+// updateServiceSpecWithDeadline whitelists iprange on the service until
+// deadline, and returns the renewal count stored with the entry.
+func updateServiceSpecWithDeadline(ctx context.Context, iprange string, ns string, deadline string, s *api_v1.Service, c kubernetes.Interface) (int, error) {
+	if cfg.DryRun {
+		logInfof("Dry-run: would whitelist %s on service %s/%s until %s", iprange, ns, s.ObjectMeta.Name, displayDeadline(deadline))
+		return 0, nil
+	}
+	if isBaselineRange(iprange) {
+		return 0, errBadRequest("Range %s is a baseline range and always allowed, no entry needed", iprange)
+	}
+	if err := checkAnnotationBudget(s, iprange, deadline); err != nil {
+		// Expired entries may be holding space; sweep them now so a
+		// retry can succeed.
+		logWarnf("%s, triggering an expiry sweep", err)
+		go func() {
+			if sweepErr := IterateAnnotations(context.Background(), s, c); sweepErr != nil {
+				logErrorf("Expiry sweep of service %s/%s failed: %s", s.ObjectMeta.Namespace, s.ObjectMeta.Name, sweepErr)
+			}
+		}()
+		return 0, err
+	}
+	renewals := 0
+	err := updateServiceWithRetry(ctx, s, c, func(svc *api_v1.Service) error {
+		if covering := coveringRange(svc.Spec.LoadBalancerSourceRanges, iprange); covering != "" && covering != iprange && !isPlaceholderRange(covering) {
+			if isBaselineRange(covering) {
+				return errBadRequest("Range %s is already covered by baseline range %s, no entry needed", iprange, covering)
+			}
+			// Covered by a broader whitelisted entry: renew that
+			// entry's deadline instead of adding a redundant narrower
+			// rule.
+			var err error
+			if renewals, err = nextRenewalCount(svc, covering); err != nil {
+				return err
+			}
+			value := formatAnnotationValue(annotationValue{Deadline: deadline, Requester: requesterFromContext(ctx), Reason: reasonFromContext(ctx), Renewals: renewals})
+			logInfof(withRequestID(ctx, "Range %s is covered by existing range %s, renewing the covering entry"), iprange, covering)
+			updateServiceAnnotation(covering, value, svc)
+			return nil
+		}
+		var err error
+		if renewals, err = nextRenewalCount(svc, iprange); err != nil {
+			return err
+		}
+		value := formatAnnotationValue(annotationValue{Deadline: deadline, Requester: requesterFromContext(ctx), Reason: reasonFromContext(ctx), Renewals: renewals})
+		superseded := rangesCoveredBy(iprange, svc.Spec.LoadBalancerSourceRanges)
+		ipranges, err := reconcileSourceRanges(svc.Spec.LoadBalancerSourceRanges, iprange, "add")
+		if err != nil {
+			return err
+		}
+		if !isPlaceholderRange(iprange) {
+			// A real entry replaces the deny-all placeholder.
+			ipranges = withoutPlaceholder(ipranges)
+		}
+		if cfg.MaxRangesPerService > 0 && len(ipranges) > cfg.MaxRangesPerService {
+			return errBadRequest("Service %s already has the maximum of %d whitelisted ranges", svc.ObjectMeta.Name, cfg.MaxRangesPerService)
+		}
+		applySourceRangesToSpec(ipranges, svc)
+		for _, v := range superseded {
+			logInfof(withRequestID(ctx, "Range %s supersedes existing entry %s, collapsing it"), iprange, v)
+			removeServiceAnnotation(v, svc)
+		}
+		updateServiceAnnotation(iprange, value, svc)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	metrics.incRulesAdded()
+	recordStateEntry(c, s, iprange, deadline)
+	recordServiceEvent(c, s, eventReasonAdded, "Whitelisted %s until %s", iprange, displayDeadline(deadline))
+	notifyAsync(notifyEvent{
+		Action:    "add",
+		Service:   s.ObjectMeta.Name,
+		Namespace: ns,
+		IpAddress: iprange,
+		Deadline:  deadline,
+		Requester: requesterFromContext(ctx),
+	})
+	return renewals, nil
+}
 
-	annotationKey := fmt.Sprintf("%s.%s", annotationKeyPrefix, iprange)
-	annotationValue := fmt.Sprintf("%s", deadline)
+// managedAnnotationValue returns the stored whitelist entry for the
+// range, under any known prefix.
+func managedAnnotationValue(s *api_v1.Service, iprange string) (annotationValue, bool) {
+	for _, prefix := range allAnnotationPrefixes() {
+		key := fmt.Sprintf("%s.%s", prefix, encodeRangeKey(iprange))
+		if raw, ok := s.ObjectMeta.Annotations[key]; ok {
+			return parseAnnotationValue(raw), true
+		}
+	}
+	return annotationValue{}, false
+}
 
-	s.ObjectMeta.Annotations[annotationKey] = annotationValue
-	return deadline
+// nextRenewalCount returns the renewal counter to store with a new
+// deadline for the range: one more than the live entry's count, or
+// zero for a fresh grant (no existing entry, or one that has already
+// expired). It rejects the renewal once the configured limit is
+// exhausted.
+func nextRenewalCount(s *api_v1.Service, iprange string) (int, error) {
+	prev, ok := managedAnnotationValue(s, iprange)
+	if !ok {
+		return 0, nil
+	}
+	if t, err := parseDeadline(prev.Deadline); err == nil && t.Before(time.Now()) {
+		// Expired but not yet swept: this is a fresh grant, so the
+		// counter starts over.
+		return 0, nil
+	}
+	if cfg.MaxRenewals > 0 && prev.Renewals >= cfg.MaxRenewals {
+		return 0, errTooManyRequests("Entry %s on service %s/%s has been renewed %d times, the maximum; wait for it to expire before requesting fresh access",
+			iprange, s.ObjectMeta.Namespace, s.ObjectMeta.Name, prev.Renewals)
+	}
+	return prev.Renewals + 1, nil
 }
 
-func removeServiceAnnotation(iprange string, s *api_v1.Service) {
-	annotationKey := fmt.Sprintf("%s.%s", annotationKeyPrefix, iprange)
-	delete(s.ObjectMeta.Annotations, annotationKey)
+// renewalsRemaining converts a stored renewal count into the number of
+// renewals the entry has left, nil when no limit is configured.
+func renewalsRemaining(renewals int) *int {
+	if cfg.MaxRenewals <= 0 {
+		return nil
+	}
+	remaining := cfg.MaxRenewals - renewals
+	if remaining < 0 {
+		remaining = 0
+	}
+	return &remaining
 }
 
-func IterateAnnotations(s *api_v1.Service, c *kubernetes.Clientset) error {
-	now := time.Now().Format("2006-01-02 15:04:05")
-	for a, v := range s.ObjectMeta.Annotations {
-		if strings.HasPrefix(a, annotationKeyPrefix) {
-			if v < now {
-				fmt.Printf("Time to remove this rule: %s\n", a)
-				ip := strings.TrimPrefix(a, fmt.Sprintf("%s.", annotationKeyPrefix))
-				err := RemoveIpFromService(ip, s, c)
-				if err != nil {
-					return err
-				}
-			} else {
-				fmt.Printf("Rule for %s has not expired yet\n", a)
-			}
-		}
+// Kubernetes rejects objects whose annotations total more than 256KiB.
+// The default budget leaves headroom below that, so caretaker refuses
+// an add with a clear error instead of the whole service write failing
+// opaquely at the API server.
+const defaultMaxAnnotationBytes = 200 << 10
+
+func annotationsSize(s *api_v1.Service) int {
+	size := 0
+	for k, v := range s.ObjectMeta.Annotations {
+		size += len(k) + len(v)
 	}
-	fmt.Printf("Finished checking rules for service %s\n", s.ObjectMeta.Name)
-	return nil
+	return size
 }
 
-func GetServiceList(c *kubernetes.Clientset) *api_v1.ServiceList {
-	opts := meta_v1.ListOptions{}
-	services, _ := c.CoreV1().Services("").List(opts)
-	return services
+// checkAnnotationBudget estimates the total annotation size after
+// adding an entry for iprange and rejects the add when it would exceed
+// the configured budget.
+func checkAnnotationBudget(s *api_v1.Service, iprange string, deadline string) error {
+	if cfg.MaxAnnotationBytes <= 0 {
+		return nil
+	}
+	key := fmt.Sprintf("%s.%s", cfg.AnnotationKeyPrefix, encodeRangeKey(iprange))
+	value := formatAnnotationValue(annotationValue{Deadline: deadline})
+	estimated := annotationsSize(s) + len(key) + len(value)
+	if estimated <= cfg.MaxAnnotationBytes {
+		return nil
+	}
+	return errTooManyRequests("Whitelisting %s would put service %s/%s annotations at roughly %d bytes, over the %d byte limit",
+		iprange, s.ObjectMeta.Namespace, s.ObjectMeta.Name, estimated, cfg.MaxAnnotationBytes)
 }
 
-func RemoveIpFromService(iprange string, s *api_v1.Service, c *kubernetes.Clientset) error {
-	ns := s.ObjectMeta.Namespace
-	ipranges, err := reconcileSourceRanges(s.Spec.LoadBalancerSourceRanges, iprange, "remove")
-	if err != nil {
-		return err
+func newDeadline() string {
+	return formatDeadline(time.Now().Add(cfg.DefaultTTL))
+}
+
+// serviceDefaultTTL returns the default entry lifetime for a service.
+// A service may override the global default with its own
+// service.caretaker.defaultttl annotation; the global max cap still
+// applies when the deadline is computed.
+func serviceDefaultTTL(s *api_v1.Service) time.Duration {
+	raw, ok := s.ObjectMeta.Annotations[defaultTTLAnnotation]
+	if !ok {
+		return cfg.DefaultTTL
 	}
-	applySourceRangesToSpec(ipranges, s)
-	removeServiceAnnotation(iprange, s)
-	_, err = c.CoreV1().Services(ns).Update(s)
-	if err != nil {
-		return err
+	d, err := time.ParseDuration(raw)
+	if err != nil || d <= 0 {
+		logWarnf("Service %s/%s has unparseable %s value %q, using the global default", s.ObjectMeta.Namespace, s.ObjectMeta.Name, defaultTTLAnnotation, raw)
+		return cfg.DefaultTTL
 	}
-	return nil
+	return d
 }
 
-func ApplyRequestToCluster(ctx context.Context, data WhitelistRequest) (string, error) {
-	var clientset *kubernetes.Clientset
-	var err error
-	key := contextKey(requestTimeKey)
+// Supported deadline serializations. RFC3339 is the default; epoch
+// seconds suit external systems that ingest the annotations.
+const (
+	deadlineFormatRFC3339 = "rfc3339"
+	deadlineFormatUnix    = "unix"
+)
 
-	fmt.Printf("Request time: %v\n", ctx.Value(key))
+// formatDeadline renders a deadline for storage in an annotation, in
+// the configured serialization. Times are kept in UTC so expiry does
+// not depend on the controller's timezone.
+func formatDeadline(t time.Time) string {
+	if cfg.DeadlineFormat == deadlineFormatUnix {
+		return strconv.FormatInt(t.Unix(), 10)
+	}
+	return t.UTC().Format(time.RFC3339)
+}
 
-	clientset, err = GetClientset()
+// displayDeadline re-renders a stored deadline in the configured
+// display timezone for operator-facing output. The stored value is
+// returned unchanged when it cannot be parsed.
+func displayDeadline(deadline string) string {
+	t, err := parseDeadline(deadline)
 	if err != nil {
-		return "", err
+		return deadline
 	}
-	fmt.Printf("Received ip address %s for access to domain %s\n", data.IpAddress, data.Domain)
-	ing, err := FindIngForFqdn(data.Domain, clientset)
+	return t.In(cfg.DisplayLocation).Format(time.RFC3339)
+}
+
+// describeDeadline renders a stored deadline in the configured display
+// timezone alongside the remaining duration, so API and CLI responses
+// are self-explanatory about when access ends.
+func describeDeadline(deadline string) (local string, remaining string) {
+	t, err := parseDeadline(deadline)
 	if err != nil {
-		return "", err
+		return "", ""
 	}
+	local = t.In(cfg.DisplayLocation).Format(time.RFC3339)
+	d := time.Until(t).Round(time.Second)
+	if d < 0 {
+		d = 0
+	}
+	remaining = d.String()
+	return local, remaining
+}
 
-	fmt.Printf("Ingress name is: %s\n", ing.ObjectMeta.Name)
-	fmt.Printf("Service name is: %s\n", ing.Spec.Rules[0].IngressRuleValue.HTTP.Paths[0].Backend.ServiceName)
-
-	var service *api_v1.Service
-
-	opts := meta_v1.GetOptions{}
-	if ing.ObjectMeta.Annotations["kubernetes.io/ingress.class"] == "nginx" {
-		// TODO: find the Nginx controller service dynamically
-		service, err = clientset.CoreV1().Services("default").Get("ingress-nginx", opts)
+// deadlineForTTL computes a deadline from a caller-supplied TTL string,
+// falling back to the target service's default when it is empty.
+func deadlineForTTL(ttl string, s *api_v1.Service) (string, error) {
+	if ttl == "" {
+		d, err := capTTL(serviceDefaultTTL(s))
 		if err != nil {
 			return "", err
 		}
-	} else {
-		return "", fmt.Errorf("Only the Nginx ingress controller is supported.")
+		return formatDeadline(time.Now().Add(d)), nil
 	}
-	fmt.Printf("The service to modify: %s\n", service.ObjectMeta.Name)
-	if !IsAutoManaged(service) {
-		return "", fmt.Errorf("The service is not auto-managed.")
+	d, err := parseTTL(ttl)
+	if err != nil {
+		return "", errBadRequest("Invalid ttl %q: %s", ttl, err)
 	}
-	namespace := service.ObjectMeta.Namespace
-	deadline, err := UpdateServiceSpec(data.IpAddress, namespace, service, clientset)
+	if d <= 0 {
+		return "", errBadRequest("Invalid ttl %q: must be positive", ttl)
+	}
+	d, err = capTTL(d)
 	if err != nil {
 		return "", err
 	}
-	fmt.Printf("Successfully applied %s to the service for %s\n", data.IpAddress, data.Domain)
-	return deadline, nil
+	return formatDeadline(time.Now().Add(d)), nil
+}
+
+// ttlDayWeekPattern matches the day/week shorthand parseTTL accepts on
+// top of time.ParseDuration's units.
+var ttlDayWeekPattern = regexp.MustCompile(`^([0-9]+(?:\.[0-9]+)?)([dw])$`)
+
+// parseTTL parses a caller-supplied lifetime. It accepts everything
+// time.ParseDuration does ("90m", "1h30m") plus the day and week
+// suffixes people reach for naturally ("3d", "1w"), which the standard
+// parser does not support.
+func parseTTL(raw string) (time.Duration, error) {
+	if d, err := time.ParseDuration(raw); err == nil {
+		return d, nil
+	}
+	m := ttlDayWeekPattern.FindStringSubmatch(raw)
+	if m == nil {
+		return 0, fmt.Errorf("expected a duration like 90m, 1h30m, 3d or 1w")
+	}
+	n, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, err
+	}
+	unit := 24 * time.Hour
+	if m[2] == "w" {
+		unit = 7 * 24 * time.Hour
+	}
+	return time.Duration(n * float64(unit)), nil
+}
+
+// capTTL enforces the configured ceiling on entry lifetimes. Depending
+// on configuration an excessive TTL is either rejected or clamped to
+// the maximum. Because every add recomputes the deadline through here,
+// renewals cannot extend past the ceiling either.
+func capTTL(d time.Duration) (time.Duration, error) {
+	if cfg.MaxTTL <= 0 || d <= cfg.MaxTTL {
+		return d, nil
+	}
+	if cfg.ClampTTL {
+		logWarnf("Requested ttl %s exceeds the maximum %s, clamping", d, cfg.MaxTTL)
+		return cfg.MaxTTL, nil
+	}
+	return 0, errBadRequest("Requested ttl %s exceeds the maximum allowed %s", d, cfg.MaxTTL)
+}
+
+func updateServiceAnnotation(iprange string, value string, s *api_v1.Service) {
+	if s.ObjectMeta.Annotations == nil {
+		s.ObjectMeta.Annotations = make(map[string]string)
+	}
+	annotationKey := fmt.Sprintf("%s.%s", cfg.AnnotationKeyPrefix, encodeRangeKey(iprange))
+	s.ObjectMeta.Annotations[annotationKey] = value
+}
+
+func removeServiceAnnotation(iprange string, s *api_v1.Service) {
+	for _, prefix := range allAnnotationPrefixes() {
+		annotationKey := fmt.Sprintf("%s.%s", prefix, encodeRangeKey(iprange))
+		delete(s.ObjectMeta.Annotations, annotationKey)
+	}
+}
+
+// countManagedAnnotations returns the number of whitelist entries
+// currently recorded on the service.
+func countManagedAnnotations(s *api_v1.Service) int {
+	count := 0
+	for a := range s.ObjectMeta.Annotations {
+		if _, ok := matchAnnotationPrefix(a); ok {
+			count++
+		}
+	}
+	return count
+}
+
+// countNearExpiryAnnotations counts the whitelist entries on a service
+// whose deadline falls within the given window from now. Already
+// expired entries are excluded; they are about to be removed rather
+// than about to drop.
+func countNearExpiryAnnotations(s *api_v1.Service, window time.Duration) int {
+	count := 0
+	now := time.Now()
+	for a, raw := range s.ObjectMeta.Annotations {
+		if _, ok := matchAnnotationPrefix(a); !ok {
+			continue
+		}
+		deadline, err := parseDeadline(parseAnnotationValue(raw).Deadline)
+		if err != nil {
+			continue
+		}
+		if deadline.After(now) && deadline.Sub(now) <= window {
+			count++
+		}
+	}
+	return count
+}
+
+// allAnnotationPrefixes returns the current annotation prefix followed
+// by any configured legacy prefixes.
+func allAnnotationPrefixes() []string {
+	return append([]string{cfg.AnnotationKeyPrefix}, cfg.LegacyAnnotationPrefixes...)
+}
+
+// matchAnnotationPrefix reports which known prefix (current or legacy)
+// the annotation key belongs to, if any.
+func matchAnnotationPrefix(key string) (string, bool) {
+	for _, prefix := range allAnnotationPrefixes() {
+		if strings.HasPrefix(key, prefix+".") {
+			return prefix, true
+		}
+	}
+	return "", false
+}
+
+// findRelatedServices returns the LoadBalancer services in the same
+// namespace as s that are tied to it through ownerReferences (a shared
+// owner, or one owning the other) or through a matching value of the
+// configured related-label. The result does not include s itself.
+func findRelatedServices(ctx context.Context, s *api_v1.Service, c kubernetes.Interface) ([]api_v1.Service, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	opts := meta_v1.ListOptions{}
+	services, err := c.CoreV1().Services(s.ObjectMeta.Namespace).List(opts)
+	if err != nil {
+		return nil, err
+	}
+	var related []api_v1.Service
+	for _, candidate := range services.Items {
+		if candidate.ObjectMeta.UID == s.ObjectMeta.UID {
+			continue
+		}
+		if candidate.Spec.Type != api_v1.ServiceTypeLoadBalancer {
+			continue
+		}
+		if servicesAreRelated(s, &candidate) {
+			related = append(related, candidate)
+		}
+	}
+	return related, nil
+}
+
+func servicesAreRelated(a *api_v1.Service, b *api_v1.Service) bool {
+	for _, ref := range b.ObjectMeta.OwnerReferences {
+		if ref.UID == a.ObjectMeta.UID {
+			return true
+		}
+		for _, aref := range a.ObjectMeta.OwnerReferences {
+			if ref.UID == aref.UID {
+				return true
+			}
+		}
+	}
+	for _, aref := range a.ObjectMeta.OwnerReferences {
+		if aref.UID == b.ObjectMeta.UID {
+			return true
+		}
+	}
+	if cfg.RelatedLabel != "" {
+		av, aok := a.ObjectMeta.Labels[cfg.RelatedLabel]
+		bv, bok := b.ObjectMeta.Labels[cfg.RelatedLabel]
+		if aok && bok && av == bv {
+			return true
+		}
+	}
+	return false
+}
+
+// parseDeadline converts a stored deadline annotation value into a
+// real timestamp. It auto-detects the serialization — epoch seconds,
+// RFC3339 or the legacy local-time layout — so annotations written
+// under a different configured format are still honored.
+func parseDeadline(v string) (time.Time, error) {
+	if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(secs, 0).UTC(), nil
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation(legacyDeadlineLayout, v, time.Local)
+}
+
+func IterateAnnotations(ctx context.Context, s *api_v1.Service, c kubernetes.Interface) error {
+	if isPaused(s) {
+		logDebugf("Service %s/%s is paused, skipping expiry", s.ObjectMeta.Namespace, s.ObjectMeta.Name)
+		return nil
+	}
+	if err := ensureBaselineRanges(ctx, s, c); err != nil {
+		return err
+	}
+	if cfg.PersistState {
+		if err := reconcileStateForService(ctx, s, c); err != nil {
+			return err
+		}
+	}
+	if countManagedAnnotations(s) == 0 {
+		// Most managed services have no active exceptions; skip the
+		// scan rather than walking their annotations every tick.
+		logDebugf("Service %s/%s has no whitelist entries, skipping", s.ObjectMeta.Namespace, s.ObjectMeta.Name)
+		return nil
+	}
+	now := time.Now()
+	legacy := make(map[string]string)
+	expiring := make(map[string]string)
+	// Collect the expired entries first: removing them deletes keys,
+	// which must not happen while ranging over the map.
+	var expired, orphaned []string
+	for a, v := range s.ObjectMeta.Annotations {
+		prefix, ok := matchAnnotationPrefix(a)
+		if !ok {
+			continue
+		}
+		value := parseAnnotationValue(v)
+		deadline, err := parseDeadline(value.Deadline)
+		if err != nil {
+			logWarnf("Skipping annotation %s with unparseable deadline %q: %s", a, v, err)
+			continue
+		}
+		ip := decodeRangeKey(strings.TrimPrefix(a, fmt.Sprintf("%s.", prefix)))
+		if deadline.Before(now) {
+			logInfof("Time to remove this rule: %s", a)
+			expired = append(expired, ip)
+		} else if !rangeInList(s.Spec.LoadBalancerSourceRanges, ip) {
+			// The range was deleted from the spec externally; the
+			// annotation is an orphan and would otherwise linger.
+			orphaned = append(orphaned, ip)
+		} else {
+			logDebugf("Rule for %s has not expired yet", a)
+			if prefix != cfg.AnnotationKeyPrefix {
+				legacy[a] = ip
+			}
+			if cfg.ExpiryWarningWindow > 0 && !value.Warned && deadline.Sub(now) <= cfg.ExpiryWarningWindow {
+				expiring[a] = ip
+			}
+		}
+	}
+	if len(expired) > 0 {
+		if remaining := startupGraceRemaining(); remaining > 0 {
+			// Right after a restart the informer cache may be cold or
+			// the clock skewed; log what would go and let a later pass
+			// remove it once the grace period is over.
+			for _, ip := range expired {
+				logInfof("Deferring removal of expired entry %s on service %s/%s for %s: startup grace period", ip, s.ObjectMeta.Namespace, s.ObjectMeta.Name, remaining.Round(time.Second))
+			}
+		} else {
+			confirmed, err := confirmExpiredEntries(ctx, expired, s, c)
+			if err != nil {
+				return err
+			}
+			if len(confirmed) > 0 {
+				if err := removeExpiredFromService(ctx, confirmed, s, c); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if len(orphaned) > 0 {
+		err := dropOrphanedAnnotations(ctx, orphaned, s, c)
+		if err != nil {
+			return err
+		}
+	}
+	if len(legacy) > 0 {
+		err := migrateLegacyAnnotations(ctx, legacy, s, c)
+		if err != nil {
+			return err
+		}
+	}
+	if len(expiring) > 0 {
+		err := warnExpiringEntries(ctx, expiring, s, c)
+		if err != nil {
+			return err
+		}
+	}
+	logDebugf("Finished checking rules for service %s", s.ObjectMeta.Name)
+	return nil
+}
+
+// processStart anchors the startup grace period.
+var processStart = time.Now()
+
+func startupGraceRemaining() time.Duration {
+	if cfg.StartupGrace <= 0 {
+		return 0
+	}
+	if remaining := cfg.StartupGrace - time.Since(processStart); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+// defaultStartupGrace is deliberately short: long enough to ride out a
+// cold cache after a restart, short enough that expired entries do not
+// linger noticeably.
+const defaultStartupGrace = 30 * time.Second
+
+// confirmExpiredEntries re-reads the service directly from the API and
+// keeps only the entries whose deadline is still past, so a removal is
+// never based on a stale cached copy alone. An unreadable service
+// defers the removal to the next pass rather than acting on stale
+// data.
+func confirmExpiredEntries(ctx context.Context, expired []string, s *api_v1.Service, c kubernetes.Interface) ([]string, error) {
+	fresh, err := c.CoreV1().Services(s.ObjectMeta.Namespace).Get(s.ObjectMeta.Name, meta_v1.GetOptions{})
+	if err != nil {
+		logWarnf("Unable to confirm expired entries on service %s/%s, deferring removal: %s", s.ObjectMeta.Namespace, s.ObjectMeta.Name, err)
+		return nil, nil
+	}
+	now := time.Now()
+	var confirmed []string
+	for _, ip := range expired {
+		key := fmt.Sprintf("%s.%s", cfg.AnnotationKeyPrefix, encodeRangeKey(ip))
+		raw, ok := fresh.ObjectMeta.Annotations[key]
+		if !ok {
+			// Gone already, nothing to remove; legacy-prefix entries
+			// are still confirmed through their own keys.
+			for _, prefix := range allAnnotationPrefixes() {
+				if v, lok := fresh.ObjectMeta.Annotations[fmt.Sprintf("%s.%s", prefix, encodeRangeKey(ip))]; lok {
+					raw, ok = v, true
+					break
+				}
+			}
+			if !ok {
+				continue
+			}
+		}
+		deadline, err := parseDeadline(parseAnnotationValue(raw).Deadline)
+		if err == nil && deadline.Before(now) {
+			confirmed = append(confirmed, ip)
+		}
+	}
+	return confirmed, nil
+}
+
+// migrateLegacyAnnotations rewrites live entries found under a legacy
+// prefix to the current prefix, so they stay visible to the reconciler
+// after a prefix change. The keys of legacy map old annotation keys to
+// the IP they describe.
+func migrateLegacyAnnotations(ctx context.Context, legacy map[string]string, s *api_v1.Service, c kubernetes.Interface) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if cfg.DryRun {
+		for key := range legacy {
+			logInfof("Dry-run: would migrate legacy annotation %s on service %s/%s", key, s.ObjectMeta.Namespace, s.ObjectMeta.Name)
+		}
+		return nil
+	}
+	for key, ip := range legacy {
+		logInfof("Migrating legacy annotation %s", key)
+		updateServiceAnnotation(ip, s.ObjectMeta.Annotations[key], s)
+		delete(s.ObjectMeta.Annotations, key)
+	}
+	_, err := c.CoreV1().Services(s.ObjectMeta.Namespace).Update(s)
+	return err
+}
+
+// removeExpiredFromService drops a batch of expired ranges and their
+// annotations in a single service update, rather than one write per
+// rule.
+func removeExpiredFromService(ctx context.Context, ips []string, s *api_v1.Service, c kubernetes.Interface) error {
+	if cfg.DryRun {
+		logInfof("Dry-run: would remove %d expired rules from service %s/%s", len(ips), s.ObjectMeta.Namespace, s.ObjectMeta.Name)
+		return nil
+	}
+	err := updateServiceWithRetry(ctx, s, c, func(svc *api_v1.Service) error {
+		for _, ip := range ips {
+			ranges, err := reconcileSourceRanges(svc.Spec.LoadBalancerSourceRanges, ip, "remove")
+			if err != nil {
+				// The range may already be gone; still drop the
+				// annotation so it cannot come back.
+				logWarnf("Range %s not present on service %s/%s: %s", ip, svc.ObjectMeta.Namespace, svc.ObjectMeta.Name, err)
+			} else {
+				applySourceRangesToSpec(ranges, svc)
+			}
+			removeServiceAnnotation(ip, svc)
+		}
+		ranges, err := guardEmptySourceRanges(svc.Spec.LoadBalancerSourceRanges, svc, c)
+		if err != nil {
+			return err
+		}
+		applySourceRangesToSpec(ranges, svc)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, ip := range ips {
+		metrics.incRulesRemoved()
+		removeStateEntry(c, s, ip)
+		recordServiceEvent(c, s, eventReasonExpired, "Whitelist entry for %s expired", ip)
+		notifyAsync(notifyEvent{
+			Action:    "remove",
+			Service:   s.ObjectMeta.Name,
+			Namespace: s.ObjectMeta.Namespace,
+			IpAddress: ip,
+		})
+	}
+	return nil
+}
+
+// Policies for what happens when a removal would leave a managed
+// service with no source ranges, which Kubernetes treats as allow-all.
+const (
+	emptyRangesWarn        = "warn"
+	emptyRangesBlock       = "block"
+	emptyRangesPlaceholder = "placeholder"
+)
+
+// guardEmptySourceRanges applies the configured policy when a removal
+// would empty a service's source ranges: warn loudly (default), refuse
+// the removal, or substitute the configured placeholder range so the
+// firewall stays closed.
+func guardEmptySourceRanges(ranges []string, svc *api_v1.Service, c kubernetes.Interface) ([]string, error) {
+	if len(ranges) > 0 {
+		return ranges, nil
+	}
+	switch cfg.EmptyRangesPolicy {
+	case emptyRangesBlock:
+		return nil, fmt.Errorf("Refusing to leave service %s/%s with no source ranges, which would allow all traffic", svc.ObjectMeta.Namespace, svc.ObjectMeta.Name)
+	case emptyRangesPlaceholder:
+		logWarnf("Service %s/%s would have no source ranges, inserting placeholder %s", svc.ObjectMeta.Namespace, svc.ObjectMeta.Name, cfg.PlaceholderRange)
+		return []string{cfg.PlaceholderRange}, nil
+	default:
+		logWarnf("Service %s/%s now has no source ranges and allows all traffic", svc.ObjectMeta.Namespace, svc.ObjectMeta.Name)
+		recordServiceWarning(c, svc, eventReasonOpen, "Service has no whitelisted source ranges and allows all traffic")
+		return ranges, nil
+	}
+}
+
+// isPlaceholderRange reports whether the range is the deny-all
+// placeholder the empty-ranges policy inserts. Only meaningful while
+// that policy is active.
+func isPlaceholderRange(r string) bool {
+	return cfg.EmptyRangesPolicy == emptyRangesPlaceholder && r == cfg.PlaceholderRange
+}
+
+// withoutPlaceholder drops the placeholder range from the list: it
+// only stands in while the list would otherwise be empty, and carries
+// no annotation so it never expires on its own.
+func withoutPlaceholder(ranges []string) []string {
+	out := ranges[:0]
+	for _, r := range ranges {
+		if isPlaceholderRange(r) {
+			continue
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+// isBaselineRange reports whether the range is one of the configured
+// always-allowed baseline ranges.
+func isBaselineRange(iprange string) bool {
+	for _, baseline := range cfg.BaselineRanges {
+		if baseline == iprange {
+			return true
+		}
+	}
+	return false
+}
+
+// ensureBaselineRanges re-asserts the configured baseline ranges on a
+// managed service, so internal CIDRs (monitoring, VPN) stay present
+// even if someone deleted them by hand. Baseline ranges carry no
+// deadline annotations: they are permanent and never expire.
+func ensureBaselineRanges(ctx context.Context, s *api_v1.Service, c kubernetes.Interface) error {
+	var missing []string
+	for _, baseline := range cfg.BaselineRanges {
+		if !rangeInList(s.Spec.LoadBalancerSourceRanges, baseline) {
+			missing = append(missing, baseline)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	if cfg.DryRun {
+		logInfof("Dry-run: would re-assert baseline ranges %v on service %s/%s", missing, s.ObjectMeta.Namespace, s.ObjectMeta.Name)
+		return nil
+	}
+	logInfof("Re-asserting baseline ranges %v on service %s/%s", missing, s.ObjectMeta.Namespace, s.ObjectMeta.Name)
+	return updateServiceWithRetry(ctx, s, c, func(svc *api_v1.Service) error {
+		ranges := svc.Spec.LoadBalancerSourceRanges
+		for _, baseline := range cfg.BaselineRanges {
+			if !rangeInList(ranges, baseline) {
+				ranges = append(ranges, baseline)
+			}
+		}
+		applySourceRangesToSpec(ranges, svc)
+		return nil
+	})
+}
+
+// warnExpiringEntries notifies about entries entering the configured
+// warning window before their deadline, so access is not cut off by
+// surprise. Each entry is marked warned so the notification fires only
+// once.
+func warnExpiringEntries(ctx context.Context, entries map[string]string, s *api_v1.Service, c kubernetes.Interface) error {
+	for key, ip := range entries {
+		value := parseAnnotationValue(s.ObjectMeta.Annotations[key])
+		logInfof("Whitelist entry %s on service %s/%s expires soon, at %s", ip, s.ObjectMeta.Namespace, s.ObjectMeta.Name, displayDeadline(value.Deadline))
+		recordServiceEvent(c, s, eventReasonExpiring, "Whitelist entry for %s expires at %s", ip, displayDeadline(value.Deadline))
+		notifyAsync(notifyEvent{
+			Action:    "expiring",
+			Service:   s.ObjectMeta.Name,
+			Namespace: s.ObjectMeta.Namespace,
+			IpAddress: ip,
+			Deadline:  value.Deadline,
+			Requester: value.Requester,
+		})
+	}
+	if cfg.DryRun {
+		return nil
+	}
+	return updateServiceWithRetry(ctx, s, c, func(svc *api_v1.Service) error {
+		for key := range entries {
+			raw, ok := svc.ObjectMeta.Annotations[key]
+			if !ok {
+				continue
+			}
+			value := parseAnnotationValue(raw)
+			value.Warned = true
+			svc.ObjectMeta.Annotations[key] = formatAnnotationValue(value)
+		}
+		return nil
+	})
+}
+
+func GetServiceList(ctx context.Context, c kubernetes.Interface) (*api_v1.ServiceList, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if cfg.ServiceCacheTTL > 0 {
+		if cached := svcListCache.get(cfg.ServiceCacheTTL); cached != nil {
+			return cached, nil
+		}
+	}
+	services := &api_v1.ServiceList{}
+	for _, namespace := range watchNamespaces() {
+		list, err := c.CoreV1().Services(namespace).List(meta_v1.ListOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("Unable to list services: %s", err)
+		}
+		services.Items = append(services.Items, list.Items...)
+	}
+	if cfg.ServiceCacheTTL > 0 {
+		svcListCache.put(services)
+	}
+	return services, nil
+}
+
+func RemoveIpFromService(ctx context.Context, iprange string, s *api_v1.Service, c kubernetes.Interface) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	ns := s.ObjectMeta.Namespace
+	if isBaselineRange(iprange) {
+		return errBadRequest("Range %s is a baseline range and cannot be removed", iprange)
+	}
+	if !rangeInList(s.Spec.LoadBalancerSourceRanges, iprange) {
+		// Distinguish "never whitelisted" from "the spec range was
+		// deleted by hand but the annotation survived": the latter is
+		// already in the desired state and only needs the orphaned
+		// annotation cleaned up.
+		if hasManagedAnnotation(s, iprange) {
+			return removeOrphanedAnnotation(ctx, iprange, s, c)
+		}
+		return errNotFound("IP %s is not whitelisted on service %s/%s", iprange, ns, s.ObjectMeta.Name)
+	}
+	if cfg.DryRun {
+		logInfof("Dry-run: would remove %s from service %s/%s", iprange, ns, s.ObjectMeta.Name)
+		return nil
+	}
+	// Retry on conflicts like the add path: the reconciler may touch
+	// the same service between our read and update.
+	err := updateServiceWithRetry(ctx, s, c, func(svc *api_v1.Service) error {
+		ipranges, err := reconcileSourceRanges(svc.Spec.LoadBalancerSourceRanges, iprange, "remove")
+		if err != nil {
+			// The entry disappeared between read and update, most
+			// likely expired by the reconciler.
+			return errNotFound("IP %s is no longer whitelisted on service %s/%s", iprange, ns, svc.ObjectMeta.Name)
+		}
+		ipranges, err = guardEmptySourceRanges(ipranges, svc, c)
+		if err != nil {
+			return err
+		}
+		applySourceRangesToSpec(ipranges, svc)
+		removeServiceAnnotation(iprange, svc)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	metrics.incRulesRemoved()
+	removeStateEntry(c, s, iprange)
+	recordServiceEvent(c, s, eventReasonRemoved, "Whitelist entry for %s removed", iprange)
+	notifyAsync(notifyEvent{
+		Action:    "remove",
+		Service:   s.ObjectMeta.Name,
+		Namespace: ns,
+		IpAddress: iprange,
+	})
+	return nil
+}
+
+// dropOrphanedAnnotations removes deadline annotations whose source
+// ranges were deleted from the spec externally, so annotations and
+// spec stay in sync regardless of manual edits.
+func dropOrphanedAnnotations(ctx context.Context, ips []string, s *api_v1.Service, c kubernetes.Interface) error {
+	if cfg.DryRun {
+		logInfof("Dry-run: would drop %d orphaned annotations from service %s/%s", len(ips), s.ObjectMeta.Namespace, s.ObjectMeta.Name)
+		return nil
+	}
+	err := updateServiceWithRetry(ctx, s, c, func(svc *api_v1.Service) error {
+		for _, ip := range ips {
+			if rangeInList(svc.Spec.LoadBalancerSourceRanges, ip) {
+				// The range reappeared between read and update; the
+				// annotation is not an orphan after all.
+				continue
+			}
+			removeServiceAnnotation(ip, svc)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, ip := range ips {
+		logInfof("Dropped orphaned annotation for %s on service %s/%s, its range was removed externally", ip, s.ObjectMeta.Namespace, s.ObjectMeta.Name)
+		removeStateEntry(c, s, ip)
+	}
+	return nil
+}
+
+// removeOrphanedAnnotation drops a deadline annotation whose source
+// range is already gone from the spec. The removal is reported as a
+// success: the service is in the state the caller asked for.
+func removeOrphanedAnnotation(ctx context.Context, iprange string, s *api_v1.Service, c kubernetes.Interface) error {
+	ns := s.ObjectMeta.Namespace
+	logWarnf("Range %s is gone from service %s/%s but its annotation remains, cleaning up", iprange, ns, s.ObjectMeta.Name)
+	if cfg.DryRun {
+		logInfof("Dry-run: would remove the orphaned annotation for %s from service %s/%s", iprange, ns, s.ObjectMeta.Name)
+		return nil
+	}
+	err := updateServiceWithRetry(ctx, s, c, func(svc *api_v1.Service) error {
+		removeServiceAnnotation(iprange, svc)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	removeStateEntry(c, s, iprange)
+	return nil
+}
+
+// resolveDirectService targets a LoadBalancer service by name and
+// namespace, for TCP/UDP services that have no ingress. The same
+// auto-managed and requester checks apply as for the ingress path.
+func resolveDirectService(ctx context.Context, data WhitelistRequest, c kubernetes.Interface) (*api_v1.Service, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if data.Namespace == "" {
+		return nil, errBadRequest("A namespace is required when targeting a service directly")
+	}
+	if _, err := lookupNamespaces(data.Namespace); err != nil {
+		return nil, err
+	}
+	service, err := c.CoreV1().Services(data.Namespace).Get(data.Service, meta_v1.GetOptions{})
+	if api_errors.IsNotFound(err) {
+		return nil, errNotFound("No service %s found in namespace %s", data.Service, data.Namespace)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if service.Spec.Type != api_v1.ServiceTypeLoadBalancer {
+		return nil, errBadRequest("Service %s/%s is not a LoadBalancer service", data.Namespace, data.Service)
+	}
+	if !IsAutoManaged(service) {
+		return nil, errBadRequest("The service is not auto-managed.")
+	}
+	if !requesterIsAllowed(ctx, service) {
+		return nil, errNotAuthorized
+	}
+	return service, nil
+}
+
+// resolveTargetService maps a whitelist request's domain to the managed
+// controller service it should modify, and checks the caller is allowed
+// to touch it.
+func resolveTargetService(ctx context.Context, data WhitelistRequest, c kubernetes.Interface) (*api_v1.Service, error) {
+	if data.Service != "" {
+		return resolveDirectService(ctx, data, c)
+	}
+	// An explicitly named controller service is the escape hatch for
+	// setups discovery heuristics do not fit: it skips the ingress
+	// lookup entirely, though the auto-managed and requester checks
+	// still apply.
+	if data.ControllerService != "" {
+		service, err := getNamedControllerService(data.ControllerService, c)
+		if err != nil {
+			return nil, err
+		}
+		logDebugf(withRequestID(ctx, "Using explicitly requested controller service %s"), data.ControllerService)
+		if !IsAutoManaged(service) {
+			return nil, errBadRequest("The service is not auto-managed.")
+		}
+		if !requesterIsAllowed(ctx, service) {
+			return nil, errNotAuthorized
+		}
+		return service, nil
+	}
+	ing, rule, err := FindIngForFqdn(ctx, data.Domain, data.Namespace, c)
+	if err != nil {
+		return nil, err
+	}
+	backend, err := backendForRule(rule, data.Domain)
+	if err != nil {
+		return nil, err
+	}
+	if backend != nil {
+		logDebugf(withRequestID(ctx, "Domain %s matched rule host %s, backend service %s"), data.Domain, rule.Host, backend.ServiceName)
+	}
+	if cfg.RequireTLSHost && !ingressHasTLSHost(&ing, data.Domain) {
+		return nil, errBadRequest("Domain %s has no TLS entry on ingress %s", data.Domain, ing.ObjectMeta.Name)
+	}
+
+	logDebugf(withRequestID(ctx, "Ingress name is: %s"), ing.ObjectMeta.Name)
+
+	service, err := controllerServiceForIngress(ctx, &ing, data, c)
+	if err != nil {
+		return nil, err
+	}
+	logDebugf(withRequestID(ctx, "The service to modify: %s"), service.ObjectMeta.Name)
+	if !IsAutoManaged(service) {
+		return nil, errBadRequest("The service is not auto-managed.")
+	}
+	if !requesterIsAllowed(ctx, service) {
+		return nil, errNotAuthorized
+	}
+	return service, nil
+}
+
+// controllerServiceForIngress locates the controller service fronting
+// an ingress. A configured class mapping beats per-class
+// auto-discovery; an explicit controllerService in the request is
+// handled before the ingress is even looked up.
+func controllerServiceForIngress(ctx context.Context, ing *ext_v1.Ingress, data WhitelistRequest, c kubernetes.Interface) (*api_v1.Service, error) {
+	if ref, ok := cfg.ClassServices[ingressClass(ing)]; ok {
+		return getNamedControllerService(ref, c)
+	}
+	resolver, err := resolverForIngress(ing)
+	if err != nil {
+		return nil, err
+	}
+	_, endSpan := startSpan(ctx, "resolveControllerService", spanKindInternal)
+	defer endSpan()
+	return resolver(ing, data, c)
+}
+
+// A WhitelistEntry describes one currently whitelisted IP on a managed
+// service, as reported by the list endpoint.
+type WhitelistEntry struct {
+	Service   string `json:"service"`
+	Namespace string `json:"namespace"`
+	IpAddress string `json:"ipaddress"`
+	Deadline  string `json:"deadline"`
+	Requester string `json:"requester,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+	Renewals  int    `json:"renewals,omitempty"`
+	// RenewalsRemaining is how many renewals the entry has left, only
+	// reported when a max-renewals limit is configured.
+	RenewalsRemaining *int `json:"renewals_remaining,omitempty"`
+}
+
+// ListWhitelistEntries collects the whitelisted IPs and deadlines from
+// every auto-managed service in the cluster.
+func ListWhitelistEntries(ctx context.Context, c kubernetes.Interface) ([]WhitelistEntry, error) {
+	services, err := GetServiceList(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	entries := []WhitelistEntry{}
+	for i := range services.Items {
+		s := &services.Items[i]
+		if !IsAutoManaged(s) {
+			continue
+		}
+		for a, v := range s.ObjectMeta.Annotations {
+			prefix, ok := matchAnnotationPrefix(a)
+			if !ok {
+				continue
+			}
+			value := parseAnnotationValue(v)
+			entries = append(entries, WhitelistEntry{
+				Service:           s.ObjectMeta.Name,
+				Namespace:         s.ObjectMeta.Namespace,
+				IpAddress:         decodeRangeKey(strings.TrimPrefix(a, fmt.Sprintf("%s.", prefix))),
+				Deadline:          value.Deadline,
+				Requester:         value.Requester,
+				Reason:            value.Reason,
+				Renewals:          value.Renewals,
+				RenewalsRemaining: renewalsRemaining(value.Renewals),
+			})
+		}
+	}
+	return entries, nil
+}
+
+// A MatchResult reports the outcome of applying a whitelist request to
+// one of the services matched in allMatches mode.
+type MatchResult struct {
+	Service   string `json:"service"`
+	Namespace string `json:"namespace"`
+	Status    string `json:"status"`
+	Deadline  string `json:"deadline,omitempty"`
+}
+
+// ApplyRequestToAllMatches whitelists the IP on every controller
+// service whose ingress serves the domain, rather than treating
+// multiple matches as ambiguous. Failures on one service do not stop
+// the others; each service's outcome is reported separately.
+func ApplyRequestToAllMatches(ctx context.Context, data WhitelistRequest) ([]MatchResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	domain, err := normalizeDomain(data.Domain)
+	if err != nil {
+		return nil, err
+	}
+	data.Domain = domain
+	clientset, err := GetClientsetFor(data.Cluster)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.RequireTicket && data.Ticket == "" {
+		return nil, errBadRequest("A ticket reference is required for whitelist requests")
+	}
+	iprange, err := normalizeIpRange(data.IpAddress)
+	if err != nil {
+		return nil, err
+	}
+	data.IpAddress = iprange
+	ctx = context.WithValue(ctx, contextKey(reasonKey), data.Reason)
+	matches, err := findAllIngForFqdn(ctx, data.Domain, data.Namespace, clientset)
+	if err != nil {
+		return nil, err
+	}
+	// Several ingresses can front the same controller; apply to each
+	// service once.
+	seen := make(map[string]bool)
+	var services []*api_v1.Service
+	var results []MatchResult
+	for i := range matches {
+		service, err := controllerServiceForIngress(ctx, &matches[i].ing, data, clientset)
+		if err != nil {
+			results = append(results, MatchResult{
+				Service:   matches[i].ing.ObjectMeta.Name,
+				Namespace: matches[i].ing.ObjectMeta.Namespace,
+				Status:    fmt.Sprintf("resolving controller for ingress: %s", err),
+			})
+			continue
+		}
+		key := fmt.Sprintf("%s/%s", service.ObjectMeta.Namespace, service.ObjectMeta.Name)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		services = append(services, service)
+	}
+	for _, service := range services {
+		result := MatchResult{Service: service.ObjectMeta.Name, Namespace: service.ObjectMeta.Namespace}
+		deadline, err := applyToService(ctx, data, service, clientset)
+		if err != nil {
+			result.Status = fmt.Sprintf("%s", err)
+		} else {
+			result.Status = "whitelisted"
+			result.Deadline = deadline
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// applyToService runs the per-service half of an add: the same checks
+// and update ApplyRequestToCluster performs once its target is known.
+func applyToService(ctx context.Context, data WhitelistRequest, service *api_v1.Service, c *kubernetes.Clientset) (string, error) {
+	if !IsAutoManaged(service) {
+		return "", errBadRequest("The service is not auto-managed.")
+	}
+	if !requesterIsAllowed(ctx, service) {
+		return "", errNotAuthorized
+	}
+	if err := checkTargetAllowed(data, service, c); err != nil {
+		return "", err
+	}
+	if err := checkCooldown(service, data.IpAddress, "add"); err != nil {
+		return "", err
+	}
+	if isPaused(service) {
+		return "", errBadRequest("Service %s/%s is paused, no whitelist changes are accepted", service.ObjectMeta.Namespace, service.ObjectMeta.Name)
+	}
+	if err := checkApproval(ctx, data, service); err != nil {
+		return "", err
+	}
+	deadline, err := deadlineForTTL(data.TTL, service)
+	if err != nil {
+		return "", err
+	}
+	if _, err := updateServiceSpecWithDeadline(ctx, data.IpAddress, service.ObjectMeta.Namespace, deadline, service, c); err != nil {
+		return "", err
+	}
+	recordAction(service, data.IpAddress, "add")
+	return deadline, nil
+}
+
+// RemoveContainedRanges revokes every managed source range contained
+// in the given CIDR, deleting the ranges and their annotations in a
+// single service update. It returns the ranges that were removed.
+func RemoveContainedRanges(ctx context.Context, cidr string, s *api_v1.Service, c kubernetes.Interface) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if parseRange(cidr) == nil {
+		return nil, errBadRequest("Invalid CIDR %s", cidr)
+	}
+	ns := s.ObjectMeta.Namespace
+	if cfg.DryRun {
+		removed := rangesCoveredBy(cidr, s.Spec.LoadBalancerSourceRanges)
+		logInfof("Dry-run: would remove %d ranges within %s from service %s/%s", len(removed), cidr, ns, s.ObjectMeta.Name)
+		return removed, nil
+	}
+	var removed []string
+	err := updateServiceWithRetry(ctx, s, c, func(svc *api_v1.Service) error {
+		// Recomputed on each attempt; a retry sees a fresh spec.
+		removed = removed[:0]
+		var kept []string
+		for _, r := range svc.Spec.LoadBalancerSourceRanges {
+			if !isBaselineRange(r) && rangeCovers(cidr, r) {
+				removed = append(removed, r)
+				continue
+			}
+			kept = append(kept, r)
+		}
+		if len(removed) == 0 {
+			return errNotFound("No whitelisted ranges within %s on service %s/%s", cidr, ns, svc.ObjectMeta.Name)
+		}
+		kept, err := guardEmptySourceRanges(kept, svc, c)
+		if err != nil {
+			return err
+		}
+		applySourceRangesToSpec(kept, svc)
+		for _, r := range removed {
+			removeServiceAnnotation(r, svc)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range removed {
+		metrics.incRulesRemoved()
+		removeStateEntry(c, s, r)
+		notifyAsync(notifyEvent{
+			Action:    "remove",
+			Service:   s.ObjectMeta.Name,
+			Namespace: ns,
+			IpAddress: r,
+		})
+	}
+	recordServiceEvent(c, s, eventReasonRemoved, "Revoked %d whitelist entries within %s", len(removed), cidr)
+	return removed, nil
+}
+
+// RemoveSubnetFromCluster resolves the target service like
+// RemoveRequestFromCluster and revokes every whitelisted range
+// contained in the request's CIDR.
+func RemoveSubnetFromCluster(ctx context.Context, data WhitelistRequest) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if data.Service == "" {
+		domain, err := normalizeDomain(data.Domain)
+		if err != nil {
+			return nil, err
+		}
+		data.Domain = domain
+	}
+	clientset, err := GetClientsetFor(data.Cluster)
+	if err != nil {
+		return nil, err
+	}
+	iprange, err := normalizeIpRange(data.IpAddress)
+	if err != nil {
+		return nil, err
+	}
+	data.IpAddress = iprange
+	logInfof(withRequestID(ctx, "Received request to revoke all ranges within %s from domain %s"), data.IpAddress, data.Domain)
+	service, err := resolveTargetService(ctx, data, clientset)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkTargetAllowed(data, service, clientset); err != nil {
+		return nil, err
+	}
+	removed, err := RemoveContainedRanges(ctx, data.IpAddress, service, clientset)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range removed {
+		recordAction(service, r, "remove")
+	}
+	return removed, nil
+}
+
+// RemoveRequestFromCluster handles an on-demand removal of a
+// whitelisted IP, without waiting for its deadline to expire.
+func RemoveRequestFromCluster(ctx context.Context, data WhitelistRequest) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if data.Service == "" {
+		domain, err := normalizeDomain(data.Domain)
+		if err != nil {
+			return err
+		}
+		data.Domain = domain
+	}
+	clientset, err := GetClientsetFor(data.Cluster)
+	if err != nil {
+		return err
+	}
+	iprange, err := normalizeIpRange(data.IpAddress)
+	if err != nil {
+		return err
+	}
+	data.IpAddress = iprange
+	logInfof(withRequestID(ctx, "Received request to remove ip address %s from domain %s"), data.IpAddress, data.Domain)
+	service, err := resolveTargetService(ctx, data, clientset)
+	if err != nil {
+		return err
+	}
+	if err := checkTargetAllowed(data, service, clientset); err != nil {
+		return err
+	}
+	if err := checkCooldown(service, data.IpAddress, "remove"); err != nil {
+		return err
+	}
+	if err := RemoveIpFromService(ctx, data.IpAddress, service, clientset); err != nil {
+		return err
+	}
+	recordAction(service, data.IpAddress, "remove")
+	return nil
+}
+
+// ApplyRequestToCluster resolves the request's target service and
+// whitelists the address on it. It returns the entry's deadline and
+// how many times the entry has now been renewed.
+func ApplyRequestToCluster(ctx context.Context, data WhitelistRequest) (string, int, error) {
+	var clientset *kubernetes.Clientset
+	var err error
+	if err := ctx.Err(); err != nil {
+		return "", 0, err
+	}
+	key := contextKey(requestTimeKey)
+
+	logDebugf("Request time: %v", ctx.Value(key))
+
+	if data.Service == "" {
+		domain, err := normalizeDomain(data.Domain)
+		if err != nil {
+			return "", 0, err
+		}
+		data.Domain = domain
+	}
+	clientset, err = GetClientsetFor(data.Cluster)
+	if err != nil {
+		return "", 0, err
+	}
+	if cfg.RequireTicket && data.Ticket == "" {
+		return "", 0, errBadRequest("A ticket reference is required for whitelist requests")
+	}
+	iprange, err := normalizeIpRange(data.IpAddress)
+	if err != nil {
+		return "", 0, err
+	}
+	data.IpAddress = iprange
+	ctx = context.WithValue(ctx, contextKey(reasonKey), data.Reason)
+	logInfof(withRequestID(ctx, "Received ip address %s for access to domain %s"), data.IpAddress, data.Domain)
+	service, err := resolveTargetService(ctx, data, clientset)
+	if err != nil {
+		return "", 0, err
+	}
+	if err := checkTargetAllowed(data, service, clientset); err != nil {
+		return "", 0, err
+	}
+	if err := checkCooldown(service, data.IpAddress, "add"); err != nil {
+		return "", 0, err
+	}
+	if isPaused(service) {
+		return "", 0, errBadRequest("Service %s/%s is paused, no whitelist changes are accepted", service.ObjectMeta.Namespace, service.ObjectMeta.Name)
+	}
+	if err := checkApproval(ctx, data, service); err != nil {
+		return "", 0, err
+	}
+	namespace := service.ObjectMeta.Namespace
+	deadline, err := deadlineForTTL(data.TTL, service)
+	if err != nil {
+		return "", 0, err
+	}
+	renewals, err := updateServiceSpecWithDeadline(ctx, data.IpAddress, namespace, deadline, service, clientset)
+	if err != nil {
+		return "", 0, err
+	}
+	if cfg.ApplyToRelated {
+		related, err := findRelatedServices(ctx, service, clientset)
+		if err != nil {
+			return "", 0, err
+		}
+		for i := range related {
+			r := &related[i]
+			logInfof(withRequestID(ctx, "Applying whitelist to related service %s"), r.ObjectMeta.Name)
+			if _, err := updateServiceSpecWithDeadline(ctx, data.IpAddress, r.ObjectMeta.Namespace, deadline, r, clientset); err != nil {
+				return "", 0, err
+			}
+		}
+	}
+	recordAction(service, data.IpAddress, "add")
+	logInfof(withRequestID(ctx, "Successfully applied %s to the service for %s"), data.IpAddress, data.Domain)
+	return deadline, renewals, nil
 }
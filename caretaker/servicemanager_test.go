@@ -0,0 +1,995 @@
+package caretaker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	api_errors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	api_v1 "k8s.io/client-go/pkg/api/v1"
+	ext_v1 "k8s.io/client-go/pkg/apis/extensions/v1beta1"
+	k8s_testing "k8s.io/client-go/testing"
+
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func init() {
+	// Each test builds its own fake clientset; with a non-zero TTL the
+	// host index would leak ingresses from one test into the next.
+	cfg.IngressCacheTTL = 0
+	// The whole test binary runs inside what would be the startup
+	// grace period, which would defer every expiry under test.
+	cfg.StartupGrace = 0
+}
+
+const legacyTestPrefix = "service.oldtaker.ipaddr"
+
+func TestIterateAnnotationsWithLegacyPrefixes(t *testing.T) {
+	cfg.LegacyAnnotationPrefixes = []string{legacyTestPrefix}
+	defer func() { cfg.LegacyAnnotationPrefixes = nil }()
+
+	expired := time.Now().AddDate(0, 0, -1).Format("2006-01-02 15:04:05")
+	live := time.Now().AddDate(0, 0, 1).Format("2006-01-02 15:04:05")
+
+	service := &api_v1.Service{
+		ObjectMeta: meta_v1.ObjectMeta{
+			Name:      "ingress-nginx",
+			Namespace: "default",
+			Annotations: map[string]string{
+				defaultMgmtAnnotation:                   "true",
+				defaultAnnotationKeyPrefix + ".1.2.3.4": expired,
+				legacyTestPrefix + ".5.6.7.8":           live,
+				legacyTestPrefix + ".9.10.11.12":        expired,
+				"unrelated.example.com/annotation":      "untouched",
+			},
+		},
+		Spec: api_v1.ServiceSpec{
+			Type:                     api_v1.ServiceTypeLoadBalancer,
+			LoadBalancerSourceRanges: []string{"1.2.3.4", "5.6.7.8", "9.10.11.12"},
+		},
+	}
+	clientset := fake.NewSimpleClientset(service)
+
+	err := IterateAnnotations(context.Background(), service, clientset)
+	if err != nil {
+		t.Fatalf("IterateAnnotations returned error: %s", err)
+	}
+
+	updated, err := clientset.CoreV1().Services("default").Get("ingress-nginx", meta_v1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to fetch service: %s", err)
+	}
+
+	annotations := updated.ObjectMeta.Annotations
+	if _, ok := annotations[defaultAnnotationKeyPrefix+".1.2.3.4"]; ok {
+		t.Errorf("expired rule under current prefix was not removed")
+	}
+	if _, ok := annotations[legacyTestPrefix+".9.10.11.12"]; ok {
+		t.Errorf("expired rule under legacy prefix was not removed")
+	}
+	if _, ok := annotations[legacyTestPrefix+".5.6.7.8"]; ok {
+		t.Errorf("live legacy rule was not migrated away from the legacy prefix")
+	}
+	if got := annotations[defaultAnnotationKeyPrefix+".5.6.7.8"]; got != live {
+		t.Errorf("live legacy rule not migrated to current prefix: got %q, want %q", got, live)
+	}
+	if got := annotations["unrelated.example.com/annotation"]; got != "untouched" {
+		t.Errorf("unrelated annotation was modified: got %q", got)
+	}
+
+	ranges := updated.Spec.LoadBalancerSourceRanges
+	if len(ranges) != 1 || ranges[0] != "5.6.7.8" {
+		t.Errorf("unexpected source ranges after reconcile: %v", ranges)
+	}
+}
+
+// A TLS-only ingress can carry a matching rule with no HTTP section, or
+// an HTTP section with zero paths. Resolution must report an error for
+// these rather than panicking.
+func TestResolveTargetServiceHandlesIngressWithoutHTTPPaths(t *testing.T) {
+	cases := []struct {
+		name string
+		rule ext_v1.IngressRule
+	}{
+		{
+			name: "nil HTTP section",
+			rule: ext_v1.IngressRule{Host: "app.example.com"},
+		},
+		{
+			name: "empty paths",
+			rule: ext_v1.IngressRule{
+				Host: "app.example.com",
+				IngressRuleValue: ext_v1.IngressRuleValue{
+					HTTP: &ext_v1.HTTPIngressRuleValue{},
+				},
+			},
+		},
+	}
+	for _, tc := range cases {
+		ingress := &ext_v1.Ingress{
+			ObjectMeta: meta_v1.ObjectMeta{
+				Name:        "tls-only",
+				Namespace:   "default",
+				Annotations: map[string]string{ingressClassAnnotation: "nginx"},
+			},
+			Spec: ext_v1.IngressSpec{
+				Rules: []ext_v1.IngressRule{tc.rule},
+			},
+		}
+		clientset := fake.NewSimpleClientset(ingress)
+
+		data := WhitelistRequest{Domain: "app.example.com", IpAddress: "1.2.3.4"}
+		if _, err := resolveTargetService(context.Background(), data, clientset); err == nil {
+			t.Errorf("%s: expected an error resolving a service for a pathless ingress", tc.name)
+		}
+	}
+}
+
+func TestFindIngForFqdnWildcardHosts(t *testing.T) {
+	newIngress := func(name, host string) *ext_v1.Ingress {
+		return &ext_v1.Ingress{
+			ObjectMeta: meta_v1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec: ext_v1.IngressSpec{
+				Rules: []ext_v1.IngressRule{{Host: host}},
+			},
+		}
+	}
+
+	t.Run("wildcard matches one label", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset(newIngress("wild", "*.example.com"))
+		ing, _, err := FindIngForFqdn(context.Background(), "api.example.com", "", clientset)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if ing.ObjectMeta.Name != "wild" {
+			t.Errorf("matched ingress %q, want wild", ing.ObjectMeta.Name)
+		}
+		if _, _, err := FindIngForFqdn(context.Background(), "a.b.example.com", "", clientset); err == nil {
+			t.Errorf("wildcard matched more than one label")
+		}
+		if _, _, err := FindIngForFqdn(context.Background(), "example.com", "", clientset); err == nil {
+			t.Errorf("wildcard matched the bare domain")
+		}
+	})
+
+	t.Run("exact match beats wildcard", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset(
+			newIngress("wild", "*.example.com"),
+			newIngress("exact", "api.example.com"),
+		)
+		ing, _, err := FindIngForFqdn(context.Background(), "api.example.com", "", clientset)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if ing.ObjectMeta.Name != "exact" {
+			t.Errorf("matched ingress %q, want exact", ing.ObjectMeta.Name)
+		}
+	})
+
+	t.Run("ambiguous wildcards are an error", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset(
+			newIngress("wild-a", "*.example.com"),
+			newIngress("wild-b", "*.example.com"),
+		)
+		if _, _, err := FindIngForFqdn(context.Background(), "api.example.com", "", clientset); err == nil {
+			t.Errorf("expected an ambiguity error for overlapping wildcards")
+		}
+	})
+}
+
+func TestFindIngForFqdnMultiHostRules(t *testing.T) {
+	newPath := func(service string) ext_v1.HTTPIngressPath {
+		return ext_v1.HTTPIngressPath{Backend: ext_v1.IngressBackend{ServiceName: service}}
+	}
+	ingress := &ext_v1.Ingress{
+		ObjectMeta: meta_v1.ObjectMeta{Name: "multi", Namespace: "default"},
+		Spec: ext_v1.IngressSpec{
+			Rules: []ext_v1.IngressRule{
+				{
+					Host: "first.example.com",
+					IngressRuleValue: ext_v1.IngressRuleValue{
+						HTTP: &ext_v1.HTTPIngressRuleValue{Paths: []ext_v1.HTTPIngressPath{newPath("first-svc")}},
+					},
+				},
+				{
+					Host: "second.example.com",
+					IngressRuleValue: ext_v1.IngressRuleValue{
+						HTTP: &ext_v1.HTTPIngressRuleValue{Paths: []ext_v1.HTTPIngressPath{newPath("second-svc"), newPath("second-svc")}},
+					},
+				},
+			},
+		},
+	}
+	clientset := fake.NewSimpleClientset(ingress)
+
+	_, rule, err := FindIngForFqdn(context.Background(), "second.example.com", "", clientset)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if rule.Host != "second.example.com" {
+		t.Errorf("matched rule host %q, want second.example.com", rule.Host)
+	}
+	backend, err := backendForRule(rule, "second.example.com")
+	if err != nil {
+		t.Fatalf("unexpected error resolving backend: %s", err)
+	}
+	if backend == nil || backend.ServiceName != "second-svc" {
+		t.Errorf("resolved backend %v, want second-svc", backend)
+	}
+}
+
+func TestBackendForRuleAmbiguousBackends(t *testing.T) {
+	rule := ext_v1.IngressRule{
+		Host: "app.example.com",
+		IngressRuleValue: ext_v1.IngressRuleValue{
+			HTTP: &ext_v1.HTTPIngressRuleValue{Paths: []ext_v1.HTTPIngressPath{
+				{Path: "/a", Backend: ext_v1.IngressBackend{ServiceName: "svc-a"}},
+				{Path: "/b", Backend: ext_v1.IngressBackend{ServiceName: "svc-b"}},
+			}},
+		},
+	}
+	if _, err := backendForRule(rule, "app.example.com"); err == nil {
+		t.Errorf("expected an ambiguity error for paths routing to different services")
+	}
+}
+
+func TestFindIngForFqdnDuplicateExactHosts(t *testing.T) {
+	newIngress := func(name string) *ext_v1.Ingress {
+		return &ext_v1.Ingress{
+			ObjectMeta: meta_v1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec: ext_v1.IngressSpec{
+				Rules: []ext_v1.IngressRule{{Host: "dup.example.com"}},
+			},
+		}
+	}
+	clientset := fake.NewSimpleClientset(newIngress("dup-a"), newIngress("dup-b"))
+	if _, _, err := FindIngForFqdn(context.Background(), "dup.example.com", "", clientset); err == nil {
+		t.Errorf("expected an ambiguity error for duplicate exact hosts")
+	}
+}
+
+// newManagedService returns a managed LoadBalancer service for tests.
+func newManagedService(ranges []string, annotations map[string]string) *api_v1.Service {
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	annotations[defaultMgmtAnnotation] = "true"
+	return &api_v1.Service{
+		ObjectMeta: meta_v1.ObjectMeta{
+			Name:        "ingress-nginx",
+			Namespace:   "default",
+			Annotations: annotations,
+		},
+		Spec: api_v1.ServiceSpec{
+			Type:                     api_v1.ServiceTypeLoadBalancer,
+			LoadBalancerSourceRanges: ranges,
+		},
+	}
+}
+
+func TestUpdateServiceSpec(t *testing.T) {
+	service := newManagedService(nil, nil)
+	clientset := fake.NewSimpleClientset(service)
+
+	deadline, err := UpdateServiceSpec(context.Background(), "1.2.3.4", "default", service, clientset)
+	if err != nil {
+		t.Fatalf("UpdateServiceSpec returned error: %s", err)
+	}
+	if _, err := parseDeadline(deadline); err != nil {
+		t.Errorf("returned deadline %q is unparseable: %s", deadline, err)
+	}
+
+	updated, err := clientset.CoreV1().Services("default").Get("ingress-nginx", meta_v1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to fetch service: %s", err)
+	}
+	if ranges := updated.Spec.LoadBalancerSourceRanges; len(ranges) != 1 || ranges[0] != "1.2.3.4" {
+		t.Errorf("unexpected source ranges: %v", ranges)
+	}
+	value, ok := updated.ObjectMeta.Annotations[defaultAnnotationKeyPrefix+".1.2.3.4"]
+	if !ok {
+		t.Fatalf("whitelist annotation was not written")
+	}
+	if parsed := parseAnnotationValue(value); parsed.Deadline != deadline {
+		t.Errorf("annotation deadline %q does not match returned deadline %q", parsed.Deadline, deadline)
+	}
+
+	// Adding the same range again must be idempotent, not duplicate it.
+	if _, err := UpdateServiceSpec(context.Background(), "1.2.3.4", "default", updated, clientset); err != nil {
+		t.Fatalf("idempotent re-add returned error: %s", err)
+	}
+	updated, _ = clientset.CoreV1().Services("default").Get("ingress-nginx", meta_v1.GetOptions{})
+	if ranges := updated.Spec.LoadBalancerSourceRanges; len(ranges) != 1 {
+		t.Errorf("re-adding duplicated the range: %v", ranges)
+	}
+}
+
+func TestRemoveIpFromService(t *testing.T) {
+	service := newManagedService(
+		[]string{"1.2.3.4", "5.6.7.8"},
+		map[string]string{defaultAnnotationKeyPrefix + ".1.2.3.4": newDeadline()},
+	)
+	clientset := fake.NewSimpleClientset(service)
+
+	err := RemoveIpFromService(context.Background(), "1.2.3.4", service, clientset)
+	if err != nil {
+		t.Fatalf("RemoveIpFromService returned error: %s", err)
+	}
+
+	updated, err := clientset.CoreV1().Services("default").Get("ingress-nginx", meta_v1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to fetch service: %s", err)
+	}
+	if ranges := updated.Spec.LoadBalancerSourceRanges; len(ranges) != 1 || ranges[0] != "5.6.7.8" {
+		t.Errorf("unexpected source ranges after removal: %v", ranges)
+	}
+	if _, ok := updated.ObjectMeta.Annotations[defaultAnnotationKeyPrefix+".1.2.3.4"]; ok {
+		t.Errorf("whitelist annotation was not removed")
+	}
+
+	// Removing a range that is not whitelisted is an error.
+	if err := RemoveIpFromService(context.Background(), "9.9.9.9", updated, clientset); err == nil {
+		t.Errorf("expected an error removing an absent range")
+	}
+}
+
+func TestRemoveIpFromServiceCleansOrphanedAnnotation(t *testing.T) {
+	// The annotation exists but the range was deleted from the spec by
+	// hand: the removal succeeds and the orphaned annotation goes away.
+	service := newManagedService(
+		[]string{"5.6.7.8"},
+		map[string]string{defaultAnnotationKeyPrefix + ".1.2.3.4": newDeadline()},
+	)
+	clientset := fake.NewSimpleClientset(service)
+
+	if err := RemoveIpFromService(context.Background(), "1.2.3.4", service, clientset); err != nil {
+		t.Fatalf("RemoveIpFromService returned error: %s", err)
+	}
+	updated, err := clientset.CoreV1().Services("default").Get("ingress-nginx", meta_v1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to fetch service: %s", err)
+	}
+	if _, ok := updated.ObjectMeta.Annotations[defaultAnnotationKeyPrefix+".1.2.3.4"]; ok {
+		t.Errorf("orphaned annotation was not cleaned up")
+	}
+	if ranges := updated.Spec.LoadBalancerSourceRanges; len(ranges) != 1 || ranges[0] != "5.6.7.8" {
+		t.Errorf("unexpected source ranges after cleanup: %v", ranges)
+	}
+}
+
+func TestPausedServiceSkipsExpiry(t *testing.T) {
+	expired := time.Now().AddDate(0, 0, -1).Format(time.RFC3339)
+	service := newManagedService(
+		[]string{"1.2.3.4"},
+		map[string]string{
+			defaultAnnotationKeyPrefix + ".1.2.3.4": expired,
+			pausedAnnotation:                        "true",
+		},
+	)
+	clientset := fake.NewSimpleClientset(service)
+
+	if err := IterateAnnotations(context.Background(), service, clientset); err != nil {
+		t.Fatalf("IterateAnnotations returned error: %s", err)
+	}
+
+	updated, err := clientset.CoreV1().Services("default").Get("ingress-nginx", meta_v1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to fetch service: %s", err)
+	}
+	if ranges := updated.Spec.LoadBalancerSourceRanges; len(ranges) != 1 {
+		t.Errorf("expired entry was removed from a paused service: %v", ranges)
+	}
+	if _, ok := updated.ObjectMeta.Annotations[defaultAnnotationKeyPrefix+".1.2.3.4"]; !ok {
+		t.Errorf("annotation was removed from a paused service")
+	}
+	// Pausing must not affect the management intent.
+	if !IsAutoManaged(updated) {
+		t.Errorf("paused service no longer reports as auto-managed")
+	}
+}
+
+func TestIPv6RangeRoundTrip(t *testing.T) {
+	normalized, err := normalizeIpRange("2001:db8::1")
+	if err != nil {
+		t.Fatalf("normalizeIpRange returned error: %s", err)
+	}
+	if normalized != "2001:db8::1/128" {
+		t.Errorf("bare IPv6 address normalized to %q, want 2001:db8::1/128", normalized)
+	}
+
+	service := newManagedService(nil, nil)
+	clientset := fake.NewSimpleClientset(service)
+	if _, err := UpdateServiceSpec(context.Background(), normalized, "default", service, clientset); err != nil {
+		t.Fatalf("UpdateServiceSpec returned error: %s", err)
+	}
+
+	updated, err := clientset.CoreV1().Services("default").Get("ingress-nginx", meta_v1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to fetch service: %s", err)
+	}
+	if ranges := updated.Spec.LoadBalancerSourceRanges; len(ranges) != 1 || ranges[0] != normalized {
+		t.Fatalf("unexpected source ranges: %v", ranges)
+	}
+	key := defaultAnnotationKeyPrefix + "." + encodeRangeKey(normalized)
+	if _, ok := updated.ObjectMeta.Annotations[key]; !ok {
+		t.Fatalf("annotation %s was not written", key)
+	}
+
+	// Force the entry to expire and check the reconcile path decodes
+	// the key back to the original range.
+	updated.ObjectMeta.Annotations[key] = time.Now().AddDate(0, 0, -1).Format(time.RFC3339)
+	if _, err := clientset.CoreV1().Services("default").Update(updated); err != nil {
+		t.Fatalf("failed to update service: %s", err)
+	}
+	if err := IterateAnnotations(context.Background(), updated, clientset); err != nil {
+		t.Fatalf("IterateAnnotations returned error: %s", err)
+	}
+	final, _ := clientset.CoreV1().Services("default").Get("ingress-nginx", meta_v1.GetOptions{})
+	if ranges := final.Spec.LoadBalancerSourceRanges; len(ranges) != 0 {
+		t.Errorf("expired IPv6 range was not removed: %v", ranges)
+	}
+	if _, ok := final.ObjectMeta.Annotations[key]; ok {
+		t.Errorf("expired IPv6 annotation was not removed")
+	}
+}
+
+func TestCIDRRangeRoundTrip(t *testing.T) {
+	if got := encodeRangeKey("10.0.0.0/24"); got != "10.0.0.0_24" {
+		t.Errorf("encodeRangeKey = %q, want 10.0.0.0_24", got)
+	}
+	if got := decodeRangeKey("10.0.0.0_24"); got != "10.0.0.0/24" {
+		t.Errorf("decodeRangeKey = %q, want 10.0.0.0/24", got)
+	}
+
+	service := newManagedService(nil, nil)
+	clientset := fake.NewSimpleClientset(service)
+	if _, err := UpdateServiceSpec(context.Background(), "10.0.0.0/24", "default", service, clientset); err != nil {
+		t.Fatalf("UpdateServiceSpec returned error: %s", err)
+	}
+
+	updated, err := clientset.CoreV1().Services("default").Get("ingress-nginx", meta_v1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to fetch service: %s", err)
+	}
+	key := defaultAnnotationKeyPrefix + ".10.0.0.0_24"
+	if _, ok := updated.ObjectMeta.Annotations[key]; !ok {
+		t.Fatalf("annotation %s was not written, got %v", key, updated.ObjectMeta.Annotations)
+	}
+
+	updated.ObjectMeta.Annotations[key] = time.Now().AddDate(0, 0, -1).Format(time.RFC3339)
+	if _, err := clientset.CoreV1().Services("default").Update(updated); err != nil {
+		t.Fatalf("failed to update service: %s", err)
+	}
+	if err := IterateAnnotations(context.Background(), updated, clientset); err != nil {
+		t.Fatalf("IterateAnnotations returned error: %s", err)
+	}
+	final, _ := clientset.CoreV1().Services("default").Get("ingress-nginx", meta_v1.GetOptions{})
+	if ranges := final.Spec.LoadBalancerSourceRanges; len(ranges) != 0 {
+		t.Errorf("expired CIDR range was not removed: %v", ranges)
+	}
+	if _, ok := final.ObjectMeta.Annotations[key]; ok {
+		t.Errorf("expired CIDR annotation was not removed")
+	}
+}
+
+func TestParseTTL(t *testing.T) {
+	cases := []struct {
+		in   string
+		want time.Duration
+	}{
+		{"90m", 90 * time.Minute},
+		{"1h30m", 90 * time.Minute},
+		{"3d", 3 * 24 * time.Hour},
+		{"1w", 7 * 24 * time.Hour},
+		{"0.5d", 12 * time.Hour},
+	}
+	for _, tc := range cases {
+		got, err := parseTTL(tc.in)
+		if err != nil {
+			t.Errorf("parseTTL(%q) returned error: %s", tc.in, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("parseTTL(%q) = %s, want %s", tc.in, got, tc.want)
+		}
+	}
+	for _, bad := range []string{"", "3x", "d", "1wk"} {
+		if _, err := parseTTL(bad); err == nil {
+			t.Errorf("parseTTL(%q) did not return an error", bad)
+		}
+	}
+}
+
+func TestDeadlineFormatRoundTrip(t *testing.T) {
+	defer func() { cfg.DeadlineFormat = deadlineFormatRFC3339 }()
+	deadline := time.Now().Add(2 * time.Hour).Truncate(time.Second)
+	for _, format := range []string{deadlineFormatRFC3339, deadlineFormatUnix} {
+		cfg.DeadlineFormat = format
+		stored := formatDeadline(deadline)
+		got, err := parseDeadline(stored)
+		if err != nil {
+			t.Errorf("parseDeadline(%q) returned error: %s", stored, err)
+			continue
+		}
+		if !got.Equal(deadline) {
+			t.Errorf("format %s: round-tripped %q to %s, want %s", format, stored, got, deadline)
+		}
+	}
+}
+
+func TestParseDeadlineAutoDetectsFormats(t *testing.T) {
+	deadline := time.Date(2026, 3, 1, 12, 30, 0, 0, time.UTC)
+	cases := map[string]string{
+		"rfc3339": deadline.Format(time.RFC3339),
+		"unix":    "1772368200",
+		"legacy":  deadline.In(time.Local).Format(legacyDeadlineLayout),
+	}
+	for name, stored := range cases {
+		got, err := parseDeadline(stored)
+		if err != nil {
+			t.Errorf("parseDeadline(%q) [%s] returned error: %s", stored, name, err)
+			continue
+		}
+		if !got.Equal(deadline) {
+			t.Errorf("parseDeadline(%q) [%s] = %s, want %s", stored, name, got, deadline)
+		}
+	}
+}
+
+func TestReconcileSourceRangesCIDRAware(t *testing.T) {
+	t.Run("contained range is a no-op", func(t *testing.T) {
+		out, err := reconcileSourceRanges([]string{"10.0.0.0/24"}, "10.0.0.5/32", "add")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(out) != 1 || out[0] != "10.0.0.0/24" {
+			t.Errorf("unexpected ranges: %v", out)
+		}
+	})
+
+	t.Run("superseding range collapses narrower entries", func(t *testing.T) {
+		out, err := reconcileSourceRanges([]string{"10.0.0.5/32", "10.0.1.9", "192.168.0.1"}, "10.0.0.0/16", "add")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(out) != 2 || out[0] != "192.168.0.1" || out[1] != "10.0.0.0/16" {
+			t.Errorf("unexpected ranges: %v", out)
+		}
+	})
+
+	t.Run("disjoint ranges accumulate", func(t *testing.T) {
+		out, err := reconcileSourceRanges([]string{"10.0.0.0/24"}, "192.168.1.0/24", "add")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(out) != 2 {
+			t.Errorf("unexpected ranges: %v", out)
+		}
+	})
+}
+
+func TestAddCoveredRangeRenewsCoveringEntry(t *testing.T) {
+	coveringKey := defaultAnnotationKeyPrefix + "." + encodeRangeKey("10.0.0.0/24")
+	service := newManagedService(
+		[]string{"10.0.0.0/24"},
+		map[string]string{coveringKey: formatAnnotationValue(annotationValue{Deadline: newDeadline()})},
+	)
+	clientset := fake.NewSimpleClientset(service)
+
+	deadline := formatDeadline(time.Now().Add(4 * time.Hour))
+	_, err := updateServiceSpecWithDeadline(context.Background(), "10.0.0.5/32", "default", deadline, service, clientset)
+	if err != nil {
+		t.Fatalf("updateServiceSpecWithDeadline returned error: %s", err)
+	}
+	updated, err := clientset.CoreV1().Services("default").Get("ingress-nginx", meta_v1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to fetch service: %s", err)
+	}
+	if ranges := updated.Spec.LoadBalancerSourceRanges; len(ranges) != 1 || ranges[0] != "10.0.0.0/24" {
+		t.Errorf("unexpected source ranges: %v", ranges)
+	}
+	if _, ok := updated.ObjectMeta.Annotations[defaultAnnotationKeyPrefix+"."+encodeRangeKey("10.0.0.5/32")]; ok {
+		t.Errorf("a redundant annotation was added for the covered range")
+	}
+	if got := parseAnnotationValue(updated.ObjectMeta.Annotations[coveringKey]).Deadline; got != deadline {
+		t.Errorf("covering entry deadline = %q, want %q", got, deadline)
+	}
+}
+
+func TestRemoveStopsWhenContextCancelled(t *testing.T) {
+	service := newManagedService(
+		[]string{"1.2.3.4"},
+		map[string]string{defaultAnnotationKeyPrefix + ".1.2.3.4": newDeadline()},
+	)
+	clientset := fake.NewSimpleClientset(service)
+	ctx, cancel := context.WithCancel(context.Background())
+	// Cancel mid-operation: the first update conflicts and cancels the
+	// context, so the retry loop must stop instead of trying again.
+	updates := 0
+	clientset.PrependReactor("update", "services", func(action k8s_testing.Action) (bool, runtime.Object, error) {
+		updates++
+		cancel()
+		return true, nil, api_errors.NewConflict(schema.GroupResource{Resource: "services"}, service.ObjectMeta.Name, fmt.Errorf("conflict"))
+	})
+
+	if err := RemoveIpFromService(ctx, "1.2.3.4", service, clientset); err == nil {
+		t.Fatalf("expected an error removing with a cancelled context")
+	}
+	if updates != 1 {
+		t.Errorf("update was attempted %d times after cancellation, want no retries", updates)
+	}
+}
+
+// benchmarkFindIngForFqdn measures a host lookup against a synthetic
+// set of a few thousand ingresses, with and without the host index.
+func benchmarkFindIngForFqdn(b *testing.B, ttl time.Duration) {
+	objects := make([]runtime.Object, 0, 2000)
+	for i := 0; i < 2000; i++ {
+		objects = append(objects, &ext_v1.Ingress{
+			ObjectMeta: meta_v1.ObjectMeta{Name: fmt.Sprintf("ing-%d", i), Namespace: "default"},
+			Spec: ext_v1.IngressSpec{
+				Rules: []ext_v1.IngressRule{{Host: fmt.Sprintf("app-%d.example.com", i)}},
+			},
+		})
+	}
+	clientset := fake.NewSimpleClientset(objects...)
+	cfg.IngressCacheTTL = ttl
+	ingressIndex.reset()
+	defer func() {
+		cfg.IngressCacheTTL = 0
+		ingressIndex.reset()
+	}()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := FindIngForFqdn(context.Background(), "app-1500.example.com", "", clientset); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFindIngForFqdnUncached(b *testing.B) {
+	benchmarkFindIngForFqdn(b, 0)
+}
+
+func BenchmarkFindIngForFqdnIndexed(b *testing.B) {
+	benchmarkFindIngForFqdn(b, time.Minute)
+}
+
+func TestPatchStrategyWritesOnlyManagedFields(t *testing.T) {
+	previous := cfg.UpdateStrategy
+	cfg.UpdateStrategy = updateStrategyPatch
+	defer func() { cfg.UpdateStrategy = previous }()
+
+	capturePatch := func(clientset *fake.Clientset, patched *[]byte) {
+		clientset.PrependReactor("patch", "services", func(action k8s_testing.Action) (bool, runtime.Object, error) {
+			*patched = action.(k8s_testing.PatchActionImpl).GetPatch()
+			return true, &api_v1.Service{}, nil
+		})
+	}
+	decodePatch := func(t *testing.T, patched []byte) map[string]interface{} {
+		if patched == nil {
+			t.Fatalf("no patch was sent")
+		}
+		doc := map[string]interface{}{}
+		if err := json.Unmarshal(patched, &doc); err != nil {
+			t.Fatalf("patch is not valid JSON: %s", err)
+		}
+		for key := range doc {
+			if key != "metadata" && key != "spec" {
+				t.Errorf("patch touches unexpected top-level field %q", key)
+			}
+		}
+		metadata := doc["metadata"].(map[string]interface{})
+		for key := range metadata {
+			if key != "resourceVersion" && key != "annotations" {
+				t.Errorf("patch touches unexpected metadata field %q", key)
+			}
+		}
+		if spec, ok := doc["spec"].(map[string]interface{}); ok {
+			for key := range spec {
+				if key != "loadBalancerSourceRanges" {
+					t.Errorf("patch touches unexpected spec field %q", key)
+				}
+			}
+		}
+		return doc
+	}
+
+	t.Run("add", func(t *testing.T) {
+		service := newManagedService([]string{"5.6.7.8"}, map[string]string{"unrelated": "keep"})
+		clientset := fake.NewSimpleClientset(service)
+		var patched []byte
+		capturePatch(clientset, &patched)
+
+		if _, err := UpdateServiceSpec(context.Background(), "1.2.3.4", "default", service, clientset); err != nil {
+			t.Fatalf("UpdateServiceSpec returned error: %s", err)
+		}
+		doc := decodePatch(t, patched)
+		annotations := doc["metadata"].(map[string]interface{})["annotations"].(map[string]interface{})
+		if _, ok := annotations["unrelated"]; ok {
+			t.Errorf("patch touches the unrelated annotation")
+		}
+		if _, ok := annotations[defaultAnnotationKeyPrefix+".1.2.3.4"]; !ok {
+			t.Errorf("patch is missing the whitelist annotation: %s", patched)
+		}
+		ranges := doc["spec"].(map[string]interface{})["loadBalancerSourceRanges"].([]interface{})
+		if len(ranges) != 2 {
+			t.Errorf("unexpected source ranges in patch: %v", ranges)
+		}
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		service := newManagedService(
+			[]string{"1.2.3.4", "5.6.7.8"},
+			map[string]string{defaultAnnotationKeyPrefix + ".1.2.3.4": newDeadline(), "unrelated": "keep"},
+		)
+		clientset := fake.NewSimpleClientset(service)
+		var patched []byte
+		capturePatch(clientset, &patched)
+
+		if err := RemoveIpFromService(context.Background(), "1.2.3.4", service, clientset); err != nil {
+			t.Fatalf("RemoveIpFromService returned error: %s", err)
+		}
+		doc := decodePatch(t, patched)
+		annotations := doc["metadata"].(map[string]interface{})["annotations"].(map[string]interface{})
+		if value, ok := annotations[defaultAnnotationKeyPrefix+".1.2.3.4"]; !ok || value != nil {
+			t.Errorf("patch does not remove the whitelist annotation: %s", patched)
+		}
+		if _, ok := annotations["unrelated"]; ok {
+			t.Errorf("patch touches the unrelated annotation")
+		}
+		ranges := doc["spec"].(map[string]interface{})["loadBalancerSourceRanges"].([]interface{})
+		if len(ranges) != 1 || ranges[0] != "5.6.7.8" {
+			t.Errorf("unexpected source ranges in patch: %v", ranges)
+		}
+	})
+}
+
+func TestAnnotationBudgetRejectsAdd(t *testing.T) {
+	previous := cfg.MaxAnnotationBytes
+	cfg.MaxAnnotationBytes = 1024
+	defer func() { cfg.MaxAnnotationBytes = previous }()
+
+	// Pack the service right up against the budget so one more entry
+	// cannot fit.
+	service := newManagedService(nil, map[string]string{"ballast": strings.Repeat("x", 1000)})
+	clientset := fake.NewSimpleClientset(service)
+
+	_, err := UpdateServiceSpec(context.Background(), "1.2.3.4", "default", service, clientset)
+	if err == nil {
+		t.Fatalf("expected the add to be rejected")
+	}
+	if !strings.Contains(err.Error(), "byte limit") {
+		t.Errorf("unexpected error: %s", err)
+	}
+	updated, _ := clientset.CoreV1().Services("default").Get("ingress-nginx", meta_v1.GetOptions{})
+	if len(updated.Spec.LoadBalancerSourceRanges) != 0 {
+		t.Errorf("rejected add still modified the service: %v", updated.Spec.LoadBalancerSourceRanges)
+	}
+}
+
+func TestPlaceholderOnExpiryToEmpty(t *testing.T) {
+	previousPolicy := cfg.EmptyRangesPolicy
+	cfg.EmptyRangesPolicy = emptyRangesPlaceholder
+	defer func() { cfg.EmptyRangesPolicy = previousPolicy }()
+
+	expired := formatDeadline(time.Now().Add(-time.Hour))
+	service := newManagedService(
+		[]string{"1.2.3.4"},
+		map[string]string{defaultAnnotationKeyPrefix + ".1.2.3.4": expired},
+	)
+	clientset := fake.NewSimpleClientset(service)
+
+	if err := IterateAnnotations(context.Background(), service, clientset); err != nil {
+		t.Fatalf("IterateAnnotations returned error: %s", err)
+	}
+	updated, err := clientset.CoreV1().Services("default").Get("ingress-nginx", meta_v1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to fetch service: %s", err)
+	}
+	if ranges := updated.Spec.LoadBalancerSourceRanges; len(ranges) != 1 || ranges[0] != cfg.PlaceholderRange {
+		t.Fatalf("expected only the placeholder after expiry, got %v", ranges)
+	}
+	if countManagedAnnotations(updated) != 0 {
+		t.Errorf("placeholder must not carry a whitelist annotation: %v", updated.ObjectMeta.Annotations)
+	}
+
+	// The placeholder never expires on its own: a second pass leaves
+	// it alone.
+	if err := IterateAnnotations(context.Background(), updated, clientset); err != nil {
+		t.Fatalf("second IterateAnnotations returned error: %s", err)
+	}
+	updated, _ = clientset.CoreV1().Services("default").Get("ingress-nginx", meta_v1.GetOptions{})
+	if ranges := updated.Spec.LoadBalancerSourceRanges; len(ranges) != 1 || ranges[0] != cfg.PlaceholderRange {
+		t.Fatalf("placeholder did not survive a second pass: %v", ranges)
+	}
+
+	// A real entry replaces the placeholder.
+	if _, err := UpdateServiceSpec(context.Background(), "5.6.7.8", "default", updated, clientset); err != nil {
+		t.Fatalf("UpdateServiceSpec returned error: %s", err)
+	}
+	updated, _ = clientset.CoreV1().Services("default").Get("ingress-nginx", meta_v1.GetOptions{})
+	if ranges := updated.Spec.LoadBalancerSourceRanges; len(ranges) != 1 || ranges[0] != "5.6.7.8" {
+		t.Errorf("expected the real entry to replace the placeholder, got %v", ranges)
+	}
+}
+
+func TestNormalizeDomainTrailingDotAndIDN(t *testing.T) {
+	cases := map[string]string{
+		"API.Example.Com.":        "api.example.com",
+		" api.example.com ":       "api.example.com",
+		"b\u00fccher.example.com": "xn--bcher-kva.example.com",
+	}
+	for input, want := range cases {
+		got, err := normalizeDomain(input)
+		if err != nil {
+			t.Errorf("normalizeDomain(%q) returned error: %s", input, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("normalizeDomain(%q) = %q, want %q", input, got, want)
+		}
+	}
+	if _, err := normalizeDomain("not a domain"); err == nil {
+		t.Errorf("expected an error for an invalid domain")
+	}
+}
+
+func TestFindIngForFqdnNormalizedHosts(t *testing.T) {
+	// The ingress side is normalized too: trailing-dot and IDN hosts
+	// still match a normalized request domain.
+	newIngress := func(name, host string) *ext_v1.Ingress {
+		return &ext_v1.Ingress{
+			ObjectMeta: meta_v1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec: ext_v1.IngressSpec{
+				Rules: []ext_v1.IngressRule{{Host: host}},
+			},
+		}
+	}
+	clientset := fake.NewSimpleClientset(
+		newIngress("dotted", "dot.example.com."),
+		newIngress("idn", "b\u00fccher.example.com"),
+	)
+
+	for domain, want := range map[string]string{
+		"dot.example.com":           "dotted",
+		"xn--bcher-kva.example.com": "idn",
+	} {
+		ing, _, err := FindIngForFqdn(context.Background(), domain, "", clientset)
+		if err != nil {
+			t.Errorf("FindIngForFqdn(%q) returned error: %s", domain, err)
+			continue
+		}
+		if ing.ObjectMeta.Name != want {
+			t.Errorf("FindIngForFqdn(%q) matched %q, want %q", domain, ing.ObjectMeta.Name, want)
+		}
+	}
+}
+
+func TestSweepSurvivesServiceListError(t *testing.T) {
+	// A failing List must surface as an error the worker can log and
+	// retry, not as a nil service list that panics the sweep.
+	cfg.ServiceCacheTTL = 0
+	defer func() { cfg.ServiceCacheTTL = defaultServiceCacheTTL }()
+
+	clientset := fake.NewSimpleClientset()
+	clientset.PrependReactor("list", "services", func(action k8s_testing.Action) (bool, runtime.Object, error) {
+		return true, nil, fmt.Errorf("apiserver unavailable")
+	})
+
+	if _, err := GetServiceList(context.Background(), clientset); err == nil {
+		t.Fatalf("GetServiceList returned no error for a failing List")
+	}
+	if _, err := runManualSweep(context.Background(), clientset); err == nil {
+		t.Fatalf("runManualSweep returned no error for a failing List")
+	}
+}
+
+func TestResolverForIngressClassStyles(t *testing.T) {
+	// The class may come from the legacy annotation or, on modern
+	// clusters, from spec.ingressClassName, which the networking
+	// conversion folds into the annotation.
+	annotated := &ext_v1.Ingress{
+		ObjectMeta: meta_v1.ObjectMeta{
+			Name:        "annotated",
+			Annotations: map[string]string{ingressClassAnnotation: "nginx"},
+		},
+	}
+	if _, err := resolverForIngress(annotated); err != nil {
+		t.Errorf("annotation-declared nginx class rejected: %s", err)
+	}
+
+	className := "nginx"
+	ni := networkingIngress{ObjectMeta: meta_v1.ObjectMeta{Name: "modern"}}
+	ni.Spec.IngressClassName = &className
+	converted := convertNetworkingIngress(ni)
+	if got := ingressClass(&converted); got != "nginx" {
+		t.Fatalf("ingressClass after conversion = %q, want %q", got, "nginx")
+	}
+	if _, err := resolverForIngress(&converted); err != nil {
+		t.Errorf("spec-declared nginx class rejected: %s", err)
+	}
+}
+
+func TestResolverForIngressConfiguredClasses(t *testing.T) {
+	custom := &ext_v1.Ingress{
+		ObjectMeta: meta_v1.ObjectMeta{
+			Name:        "custom",
+			Annotations: map[string]string{ingressClassAnnotation: "nginx-internal"},
+		},
+	}
+	if _, err := resolverForIngress(custom); err == nil {
+		t.Errorf("unknown class accepted without configuration")
+	}
+
+	cfg.IngressClasses = []string{"nginx-internal"}
+	defer func() { cfg.IngressClasses = nil }()
+	if _, err := resolverForIngress(custom); err != nil {
+		t.Errorf("configured class rejected: %s", err)
+	}
+}
+
+func TestMaxRenewalsLimit(t *testing.T) {
+	cfg.MaxRenewals = 2
+	defer func() { cfg.MaxRenewals = 0 }()
+
+	service := newManagedService(nil, nil)
+	clientset := fake.NewSimpleClientset(service)
+	ctx := context.Background()
+	deadline := formatDeadline(time.Now().Add(time.Hour))
+
+	renew := func() (int, error) {
+		fresh, err := clientset.CoreV1().Services("default").Get("ingress-nginx", meta_v1.GetOptions{})
+		if err != nil {
+			t.Fatalf("failed to fetch service: %s", err)
+		}
+		return updateServiceSpecWithDeadline(ctx, "1.2.3.4", "default", deadline, fresh, clientset)
+	}
+
+	// A fresh grant starts the counter at zero; each renewal counts.
+	for attempt, want := range []int{0, 1, 2} {
+		renewals, err := renew()
+		if err != nil {
+			t.Fatalf("attempt %d returned error: %s", attempt, err)
+		}
+		if renewals != want {
+			t.Errorf("attempt %d stored %d renewals, want %d", attempt, renewals, want)
+		}
+		if remaining := renewalsRemaining(renewals); remaining == nil || *remaining != cfg.MaxRenewals-want {
+			t.Errorf("attempt %d remaining = %v, want %d", attempt, remaining, cfg.MaxRenewals-want)
+		}
+	}
+
+	// The limit is reached: a further renewal is rejected.
+	if _, err := renew(); err == nil {
+		t.Fatalf("renewal beyond the limit was accepted")
+	} else if httpStatusForError(err) != http.StatusTooManyRequests {
+		t.Errorf("status = %d, want %d", httpStatusForError(err), http.StatusTooManyRequests)
+	}
+
+	// Once the entry has expired the next grant is fresh and the
+	// counter starts over.
+	expired := formatAnnotationValue(annotationValue{Deadline: formatDeadline(time.Now().Add(-time.Hour)), Renewals: 2})
+	fresh, err := clientset.CoreV1().Services("default").Get("ingress-nginx", meta_v1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to fetch service: %s", err)
+	}
+	fresh.ObjectMeta.Annotations[defaultAnnotationKeyPrefix+"."+encodeRangeKey("1.2.3.4")] = expired
+	if _, err := clientset.CoreV1().Services("default").Update(fresh); err != nil {
+		t.Fatalf("failed to backdate entry: %s", err)
+	}
+	renewals, err := renew()
+	if err != nil {
+		t.Fatalf("fresh grant after expiry returned error: %s", err)
+	}
+	if renewals != 0 {
+		t.Errorf("fresh grant after expiry stored %d renewals, want 0", renewals)
+	}
+}
@@ -0,0 +1,63 @@
+package caretaker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// slackNotifier posts whitelist changes to a Slack incoming-webhook
+// URL. It shares the notifier interface with the generic webhook, so
+// both can be enabled at once.
+type slackNotifier struct {
+	webhookURL string
+	channel    string
+	client     *http.Client
+}
+
+func newSlackNotifier(webhookURL, channel string) *slackNotifier {
+	return &slackNotifier{
+		webhookURL: webhookURL,
+		channel:    channel,
+		client:     &http.Client{Timeout: notifyTimeout},
+	}
+}
+
+func (s *slackNotifier) name() string { return "slack" }
+
+// slackMessage is the subset of the incoming-webhook payload we use.
+type slackMessage struct {
+	Channel string `json:"channel,omitempty"`
+	Text    string `json:"text"`
+}
+
+func (s *slackNotifier) send(ctx context.Context, e notifyEvent) error {
+	text := fmt.Sprintf("Whitelist %s: `%s` on service `%s/%s`", e.Action, e.IpAddress, e.Namespace, e.Service)
+	if e.Requester != "" {
+		text += fmt.Sprintf(" requested by %s", e.Requester)
+	}
+	if e.Deadline != "" {
+		text += fmt.Sprintf(", expires %s", e.Deadline)
+	}
+	body, err := json.Marshal(slackMessage{Channel: s.channel, Text: text})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("slack returned status %d", resp.StatusCode)
+	}
+	return nil
+}
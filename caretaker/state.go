@@ -0,0 +1,200 @@
+package caretaker
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+	api_v1 "k8s.io/client-go/pkg/api/v1"
+
+	api_errors "k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The state store mirrors every managed entry into a controller-owned
+// ConfigMap, as a durable record independent of the service
+// annotations. Third-party tooling that does full Updates can clobber
+// the annotations, which would otherwise leave an IP whitelisted
+// forever; the mirror lets the reconciler detect the lost deadline and
+// repair it. The feature is opt-in via CARETAKER_PERSIST_STATE.
+//
+// Each service gets one ConfigMap data key, "namespace_name" (both are
+// DNS names, so the separator cannot collide), whose value holds one
+// "ip deadline" pair per line.
+
+// stateDataKey names the ConfigMap entry holding a service's mirror.
+func stateDataKey(s *api_v1.Service) string {
+	return fmt.Sprintf("%s_%s", s.ObjectMeta.Namespace, s.ObjectMeta.Name)
+}
+
+func parseStateEntries(v string) map[string]string {
+	entries := make(map[string]string)
+	for _, line := range strings.Split(v, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 {
+			entries[fields[0]] = fields[1]
+		}
+	}
+	return entries
+}
+
+func formatStateEntries(entries map[string]string) string {
+	ips := make([]string, 0, len(entries))
+	for ip := range entries {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	lines := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		lines = append(lines, fmt.Sprintf("%s %s", ip, entries[ip]))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// mutateState applies mutate to the state ConfigMap's data, creating
+// the ConfigMap if needed and retrying on update conflicts from
+// concurrent reconcile workers.
+func mutateState(c kubernetes.Interface, mutate func(data map[string]string)) error {
+	var lastErr error
+	for attempt := 0; attempt < updateRetries; attempt++ {
+		cm, err := c.CoreV1().ConfigMaps(cfg.StateNamespace).Get(cfg.StateConfigMap, meta_v1.GetOptions{})
+		if api_errors.IsNotFound(err) {
+			cm = &api_v1.ConfigMap{
+				ObjectMeta: meta_v1.ObjectMeta{
+					Name:      cfg.StateConfigMap,
+					Namespace: cfg.StateNamespace,
+				},
+				Data: make(map[string]string),
+			}
+			mutate(cm.Data)
+			_, lastErr = c.CoreV1().ConfigMaps(cfg.StateNamespace).Create(cm)
+			if lastErr == nil {
+				return nil
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if cm.Data == nil {
+			cm.Data = make(map[string]string)
+		}
+		mutate(cm.Data)
+		_, lastErr = c.CoreV1().ConfigMaps(cfg.StateNamespace).Update(cm)
+		if lastErr == nil {
+			return nil
+		}
+		if !api_errors.IsConflict(lastErr) {
+			return lastErr
+		}
+	}
+	return lastErr
+}
+
+// recordStateEntry mirrors a whitelist entry into the state ConfigMap.
+func recordStateEntry(c kubernetes.Interface, s *api_v1.Service, ip, deadline string) {
+	if !cfg.PersistState {
+		return
+	}
+	err := mutateState(c, func(data map[string]string) {
+		key := stateDataKey(s)
+		entries := parseStateEntries(data[key])
+		entries[ip] = deadline
+		data[key] = formatStateEntries(entries)
+	})
+	if err != nil {
+		logWarnf("Unable to mirror state for %s on service %s/%s: %s", ip, s.ObjectMeta.Namespace, s.ObjectMeta.Name, err)
+	}
+}
+
+// removeStateEntry drops a whitelist entry from the state ConfigMap.
+func removeStateEntry(c kubernetes.Interface, s *api_v1.Service, ip string) {
+	if !cfg.PersistState {
+		return
+	}
+	err := mutateState(c, func(data map[string]string) {
+		key := stateDataKey(s)
+		entries := parseStateEntries(data[key])
+		delete(entries, ip)
+		if len(entries) == 0 {
+			delete(data, key)
+			return
+		}
+		data[key] = formatStateEntries(entries)
+	})
+	if err != nil {
+		logWarnf("Unable to remove mirrored state for %s on service %s/%s: %s", ip, s.ObjectMeta.Namespace, s.ObjectMeta.Name, err)
+	}
+}
+
+// reconcileStateForService compares the service's annotations against
+// the mirrored state. An entry whose annotation was clobbered gets its
+// annotation restored while the deadline is still live, or its range
+// removed outright when the recorded deadline has already passed.
+// Mirrored entries whose range is gone from the service are cleaned up.
+func reconcileStateForService(ctx context.Context, s *api_v1.Service, c kubernetes.Interface) error {
+	cm, err := c.CoreV1().ConfigMaps(cfg.StateNamespace).Get(cfg.StateConfigMap, meta_v1.GetOptions{})
+	if api_errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	entries := parseStateEntries(cm.Data[stateDataKey(s)])
+	for ip, deadlineStr := range entries {
+		if hasManagedAnnotation(s, ip) {
+			continue
+		}
+		if !rangeInList(s.Spec.LoadBalancerSourceRanges, ip) {
+			// Removed behind our back; forget the mirrored entry.
+			removeStateEntry(c, s, ip)
+			continue
+		}
+		deadline, err := parseDeadline(deadlineStr)
+		if err != nil {
+			logWarnf("Mirrored entry for %s on service %s/%s has unparseable deadline %q", ip, s.ObjectMeta.Namespace, s.ObjectMeta.Name, deadlineStr)
+			continue
+		}
+		if deadline.Before(time.Now()) {
+			logWarnf("Annotation for %s on service %s/%s was lost and its deadline has passed, removing the range", ip, s.ObjectMeta.Namespace, s.ObjectMeta.Name)
+			if err := RemoveIpFromService(ctx, ip, s, c); err != nil {
+				return err
+			}
+			continue
+		}
+		logWarnf("Annotation for %s on service %s/%s was lost, restoring it from the mirrored state", ip, s.ObjectMeta.Namespace, s.ObjectMeta.Name)
+		err = updateServiceWithRetry(ctx, s, c, func(svc *api_v1.Service) error {
+			updateServiceAnnotation(ip, formatAnnotationValue(annotationValue{Deadline: deadlineStr}), svc)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hasManagedAnnotation reports whether the service carries a whitelist
+// annotation for the range under any known prefix.
+func hasManagedAnnotation(s *api_v1.Service, ip string) bool {
+	for _, prefix := range allAnnotationPrefixes() {
+		if _, ok := s.ObjectMeta.Annotations[fmt.Sprintf("%s.%s", prefix, encodeRangeKey(ip))]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// rangeInList reports whether the range appears in the source-range
+// list.
+func rangeInList(ranges []string, ip string) bool {
+	for _, r := range ranges {
+		if r == ip {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,66 @@
+package caretaker
+
+import (
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The auth token may come from a mounted Secret file instead of the
+// environment, which keeps it out of /proc and crash dumps. The file
+// is re-read periodically so a rotated Secret is picked up without a
+// restart; fsnotify is avoided to keep the vendor tree small, and
+// kubelet-updated Secret mounts swap symlinks rather than firing
+// simple write events anyway.
+const tokenRefreshInterval = time.Minute
+
+var (
+	authTokenMu sync.RWMutex
+	authToken   string
+)
+
+// currentAuthToken returns the token the whitelist endpoints require.
+// Empty means authentication is disabled.
+func currentAuthToken() string {
+	authTokenMu.RLock()
+	defer authTokenMu.RUnlock()
+	return authToken
+}
+
+func setAuthToken(t string) {
+	authTokenMu.Lock()
+	defer authTokenMu.Unlock()
+	authToken = t
+}
+
+// refreshAuthToken resolves the effective token: the token file wins
+// over the environment value when both are set.
+func refreshAuthToken() {
+	if cfg.AuthTokenFile == "" {
+		setAuthToken(cfg.AuthToken)
+		return
+	}
+	data, err := ioutil.ReadFile(cfg.AuthTokenFile)
+	if err != nil {
+		logErrorf("Unable to read token file %s: %s", cfg.AuthTokenFile, err)
+		return
+	}
+	token := strings.TrimSpace(string(data))
+	if token != currentAuthToken() {
+		logInfof("Auth token loaded from %s", cfg.AuthTokenFile)
+	}
+	setAuthToken(token)
+}
+
+// watchAuthToken keeps re-reading the token file until stop closes.
+func watchAuthToken(stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(tokenRefreshInterval):
+			refreshAuthToken()
+		}
+	}
+}
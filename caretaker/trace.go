@@ -0,0 +1,170 @@
+package caretaker
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tracing is hand-rolled OTLP/JSON, for the same reason /metrics writes
+// the Prometheus text format by hand: the OpenTelemetry SDK would dwarf
+// the vendor tree for the handful of spans caretaker emits. Spans are
+// exported to the collector named by the standard
+// OTEL_EXPORTER_OTLP_ENDPOINT variable; tracing is off, and free, when
+// it is unset. Incoming W3C traceparent headers are honored so spans
+// join the caller's trace.
+const (
+	traceparentHeader  = "traceparent"
+	traceKey           = "traceSpan"
+	traceQueueSize     = 128
+	traceExportTimeout = 10 * time.Second
+
+	spanKindInternal = 1
+	spanKindServer   = 2
+)
+
+// otlpSpan is the subset of the OTLP span shape caretaker fills in.
+type otlpSpan struct {
+	TraceID           string `json:"traceId"`
+	SpanID            string `json:"spanId"`
+	ParentSpanID      string `json:"parentSpanId,omitempty"`
+	Name              string `json:"name"`
+	Kind              int    `json:"kind"`
+	StartTimeUnixNano string `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string `json:"endTimeUnixNano"`
+}
+
+type spanContext struct {
+	traceID string
+	spanID  string
+}
+
+func tracingEnabled() bool {
+	return cfg.OTLPEndpoint != ""
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return strings.Repeat("0", 2*n)
+	}
+	return hex.EncodeToString(b)
+}
+
+// parseTraceparent extracts the trace and parent span IDs from a W3C
+// traceparent header ("00-<trace-id>-<parent-id>-<flags>").
+func parseTraceparent(h string) (spanContext, bool) {
+	parts := strings.Split(h, "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return spanContext{}, false
+	}
+	return spanContext{traceID: parts[1], spanID: parts[2]}, true
+}
+
+// traceContextFromRequest seeds the context with the caller's trace,
+// when one is propagated.
+func traceContextFromRequest(ctx context.Context, r *http.Request) context.Context {
+	if !tracingEnabled() {
+		return ctx
+	}
+	if sc, ok := parseTraceparent(r.Header.Get(traceparentHeader)); ok {
+		ctx = context.WithValue(ctx, contextKey(traceKey), sc)
+	}
+	return ctx
+}
+
+// startSpan opens a span as a child of whatever span the context
+// carries, returning the updated context and a function that closes
+// and exports the span. When tracing is disabled both are no-ops.
+func startSpan(ctx context.Context, name string, kind int) (context.Context, func()) {
+	if !tracingEnabled() {
+		return ctx, func() {}
+	}
+	parent, _ := ctx.Value(contextKey(traceKey)).(spanContext)
+	sc := spanContext{traceID: parent.traceID, spanID: randomHex(8)}
+	if sc.traceID == "" {
+		sc.traceID = randomHex(16)
+	}
+	start := time.Now()
+	ctx = context.WithValue(ctx, contextKey(traceKey), sc)
+	return ctx, func() {
+		exportSpan(otlpSpan{
+			TraceID:           sc.traceID,
+			SpanID:            sc.spanID,
+			ParentSpanID:      parent.spanID,
+			Name:              name,
+			Kind:              kind,
+			StartTimeUnixNano: strconv.FormatInt(start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(time.Now().UnixNano(), 10),
+		})
+	}
+}
+
+var (
+	traceQueue     chan otlpSpan
+	traceQueueOnce sync.Once
+)
+
+// exportSpan hands a finished span to the background exporter. Spans
+// are dropped when the queue is full: tracing must never hold up a
+// whitelist request.
+func exportSpan(s otlpSpan) {
+	traceQueueOnce.Do(func() {
+		traceQueue = make(chan otlpSpan, traceQueueSize)
+		go traceDispatcher()
+	})
+	select {
+	case traceQueue <- s:
+	default:
+		logDebugf("Trace queue is full, dropping span %s", s.Name)
+	}
+}
+
+func traceDispatcher() {
+	client := &http.Client{Timeout: traceExportTimeout}
+	for s := range traceQueue {
+		if err := postSpan(client, s); err != nil {
+			logDebugf("Unable to export span %s: %s", s.Name, err)
+		}
+	}
+}
+
+// postSpan sends one span to the collector's OTLP/HTTP traces path.
+func postSpan(client *http.Client, s otlpSpan) error {
+	payload := map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []interface{}{map[string]interface{}{
+					"key":   "service.name",
+					"value": map[string]string{"stringValue": eventComponent},
+				}},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": eventComponent},
+				"spans": []otlpSpan{s},
+			}},
+		}},
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	url := strings.TrimSuffix(cfg.OTLPEndpoint, "/") + "/v1/traces"
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("collector returned status %d", resp.StatusCode)
+	}
+	return nil
+}
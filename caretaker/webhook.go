@@ -0,0 +1,61 @@
+package caretaker
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// webhookSignatureHeader carries an HMAC-SHA256 signature of the
+// request body, keyed with the shared secret, so the receiver can
+// verify the notification came from caretaker.
+const webhookSignatureHeader = "X-Caretaker-Signature"
+
+// webhookNotifier POSTs whitelist changes as JSON to a configured URL.
+type webhookNotifier struct {
+	url    string
+	secret string
+	client *http.Client
+}
+
+func newWebhookNotifier(url, secret string) *webhookNotifier {
+	return &webhookNotifier{
+		url:    url,
+		secret: secret,
+		client: &http.Client{Timeout: notifyTimeout},
+	}
+}
+
+func (w *webhookNotifier) name() string { return "webhook" }
+
+func (w *webhookNotifier) send(ctx context.Context, e notifyEvent) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	if w.secret != "" {
+		mac := hmac.New(sha256.New, []byte(w.secret))
+		mac.Write(body)
+		req.Header.Set(webhookSignatureHeader, fmt.Sprintf("sha256=%s", hex.EncodeToString(mac.Sum(nil))))
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}